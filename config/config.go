@@ -0,0 +1,380 @@
+// Package config loads runtime settings of the media server from a YAML file,
+// environment variables and command line flags (in increasing precedence).
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezone may be missing on the host, like in a slim container
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultConfigFile      = "config.yml"
+	DefaultFriendlyName    = "UPnP MediaServer for EPGStation"
+	DefaultRefreshInterval = 1 * time.Minute
+	DefaultCacheTTL        = 30 * time.Minute
+	DefaultSSDPMaxAge      = 1800
+	DefaultEPGStationPort  = 8888
+	DefaultDataDir         = "data"
+	DefaultTimezone        = "Asia/Tokyo"
+)
+
+var (
+	DefaultSeriesStripPatterns = []string{
+		`【[^】]*】`,           // 【新】, 【再】 and so on
+		`\[[^\]]*\]`,        // [字], [デ] and so on
+		`「[^」]*」`,           // subtitle
+		`#\s*\d+.*$`,        // #3 and the rest
+		`第\s*\d+\s*[話回].*$`, // 第12話 and the rest
+		`\(\d+\)\s*$`,       // (3)
+	}
+	DefaultSeriesEpisodePatterns = []string{
+		`#\s*(\d+)`,
+		`第\s*(\d+)\s*[話回]`,
+		`\((\d+)\)\s*$`,
+	}
+	// the first M2TS mode, which is passthrough in the default config of EPGStation
+	DefaultLiveStream = StreamMode{Container: "m2ts", Mode: 0}
+)
+
+// A StreamMode is a streaming setting of EPGStation offered to clients, as a
+// transcoded variant of recorded TS files or for live broadcasts
+type StreamMode struct {
+	// mp4 or webm, or m2ts for live broadcasts
+	Container string `yaml:"container"`
+	// index in stream.recorded.ts.mp4 (or webm), or stream.live.ts.m2ts (or
+	// mp4, webm) for live broadcasts, of config.yml of EPGStation
+	Mode int `yaml:"mode"`
+	// resolution of transcoded video like 1280x720, shown to clients if given
+	Resolution string `yaml:"resolution,omitempty"`
+}
+
+type Config struct {
+	// EPGStation base URL like http://192.168.10.10:8888
+	// Empty means EPGStation runs on the same host as this server.
+	EPGStationURL string `yaml:"epgstation_url"`
+
+	// IP address to listen on. Empty means the first non-loopback IPv4 address.
+	ListenAddress string `yaml:"listen_address"`
+	// TCP port to listen on. 0 means an arbitrary free port.
+	ListenPort int `yaml:"listen_port"`
+
+	FriendlyName    string        `yaml:"friendly_name"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// how long containers fetched from EPGStation are cached
+	CacheTTL   time.Duration `yaml:"cache_ttl"`
+	SSDPMaxAge int           `yaml:"ssdp_max_age"`
+	// IANA time zone name to group recordings by date
+	Timezone string `yaml:"timezone"`
+	// regular expressions removed from titles to group recordings into series,
+	// matched after full width alphanumerics are turned into half width
+	SeriesStripPatterns []string `yaml:"series_strip_patterns"`
+	// regular expressions capturing episode number in titles, to sort series
+	SeriesEpisodePatterns []string `yaml:"series_episode_patterns"`
+	// streaming settings of EPGStation offered as transcoded variants
+	StreamModes []StreamMode `yaml:"stream_modes"`
+	// streaming setting of EPGStation to watch live broadcasts
+	LiveStream StreamMode `yaml:"live_stream"`
+
+	// directory to keep state across restarts, like device UUID, and cache of
+	// resized thumbnails
+	DataDir string `yaml:"data_dir"`
+	// fixed device UUID. Empty means UUID persisted in DataDir.
+	DeviceUUID string `yaml:"device_uuid"`
+
+	// path of the config file actually loaded, if any
+	File string `yaml:"-"`
+	// loaded from Timezone
+	Location *time.Location `yaml:"-"`
+	// compiled from SeriesStripPatterns and SeriesEpisodePatterns
+	SeriesStrip   []*regexp.Regexp `yaml:"-"`
+	SeriesEpisode []*regexp.Regexp `yaml:"-"`
+}
+
+// environment variable name for each setting
+const (
+	envConfigFile      = "MEDIASERVER_CONFIG"
+	envEPGStation      = "EPGSTATION" // shared with `go generate` in epgstation package
+	envListenAddress   = "MEDIASERVER_LISTEN_ADDRESS"
+	envListenPort      = "MEDIASERVER_LISTEN_PORT"
+	envFriendlyName    = "MEDIASERVER_FRIENDLY_NAME"
+	envRefreshInterval = "MEDIASERVER_REFRESH_INTERVAL"
+	envCacheTTL        = "MEDIASERVER_CACHE_TTL"
+	envSSDPMaxAge      = "MEDIASERVER_SSDP_MAX_AGE"
+	envTimezone        = "MEDIASERVER_TIMEZONE"
+	envDataDir         = "MEDIASERVER_DATA_DIR"
+	envDeviceUUID      = "MEDIASERVER_DEVICE_UUID"
+)
+
+func defaultConfig() *Config {
+	return &Config{
+		FriendlyName:    DefaultFriendlyName,
+		RefreshInterval: DefaultRefreshInterval,
+		CacheTTL:        DefaultCacheTTL,
+		SSDPMaxAge:      DefaultSSDPMaxAge,
+		Timezone:        DefaultTimezone,
+		DataDir:         DefaultDataDir,
+
+		SeriesStripPatterns:   DefaultSeriesStripPatterns,
+		SeriesEpisodePatterns: DefaultSeriesEpisodePatterns,
+		LiveStream:            DefaultLiveStream,
+	}
+}
+
+// Load builds the effective configuration from defaults, config file,
+// environment variables and command line arguments, then validates it.
+func Load(args []string) (*Config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("upnp-mediaserver", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to YAML config file (env "+envConfigFile+")")
+	epgstationURL := fs.String("epgstation", "", "EPGStation base URL or host:port (env "+envEPGStation+")")
+	listenAddress := fs.String("listen-address", "", "IP address to listen on (env "+envListenAddress+")")
+	listenPort := fs.Int("listen-port", 0, "TCP port to listen on, 0 for arbitrary (env "+envListenPort+")")
+	friendlyName := fs.String("friendly-name", "", "friendly name shown on UPnP clients (env "+envFriendlyName+")")
+	refreshInterval := fs.Duration("refresh-interval", 0, "interval to poll EPGStation for changes (env "+envRefreshInterval+")")
+	cacheTTL := fs.Duration("cache-ttl", 0, "how long containers fetched from EPGStation are cached (env "+envCacheTTL+")")
+	ssdpMaxAge := fs.Int("ssdp-max-age", 0, "max-age of SSDP advertisement in seconds (env "+envSSDPMaxAge+")")
+	timezone := fs.String("timezone", "", "time zone to group recordings by date (env "+envTimezone+")")
+	dataDir := fs.String("data-dir", "", "directory to keep state across restarts (env "+envDataDir+")")
+	deviceUUID := fs.String("device-uuid", "", "fixed device UUID (env "+envDeviceUUID+")")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv(envConfigFile)
+	}
+	if err := cfg.loadFile(path); err != nil {
+		return nil, err
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "epgstation":
+			cfg.EPGStationURL = *epgstationURL
+		case "listen-address":
+			cfg.ListenAddress = *listenAddress
+		case "listen-port":
+			cfg.ListenPort = *listenPort
+		case "friendly-name":
+			cfg.FriendlyName = *friendlyName
+		case "refresh-interval":
+			cfg.RefreshInterval = *refreshInterval
+		case "cache-ttl":
+			cfg.CacheTTL = *cacheTTL
+		case "ssdp-max-age":
+			cfg.SSDPMaxAge = *ssdpMaxAge
+		case "timezone":
+			cfg.Timezone = *timezone
+		case "data-dir":
+			cfg.DataDir = *dataDir
+		case "device-uuid":
+			cfg.DeviceUUID = *deviceUUID
+		}
+	})
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile reads config file at path. When path is empty, DefaultConfigFile is
+// read only if it exists.
+func (c *Config) loadFile(path string) error {
+	explicit := path != ""
+	if !explicit {
+		path = DefaultConfigFile
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("config: %w", err)
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("config: parse %s: %w", path, err)
+	}
+	c.File = path
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	if v, ok := os.LookupEnv(envEPGStation); ok {
+		c.EPGStationURL = v
+	}
+	if v, ok := os.LookupEnv(envListenAddress); ok {
+		c.ListenAddress = v
+	}
+	if v, ok := os.LookupEnv(envListenPort); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: %s: %w", envListenPort, err)
+		}
+		c.ListenPort = port
+	}
+	if v, ok := os.LookupEnv(envFriendlyName); ok {
+		c.FriendlyName = v
+	}
+	if v, ok := os.LookupEnv(envRefreshInterval); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("config: %s: %w", envRefreshInterval, err)
+		}
+		c.RefreshInterval = d
+	}
+	if v, ok := os.LookupEnv(envCacheTTL); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("config: %s: %w", envCacheTTL, err)
+		}
+		c.CacheTTL = d
+	}
+	if v, ok := os.LookupEnv(envSSDPMaxAge); ok {
+		maxAge, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: %s: %w", envSSDPMaxAge, err)
+		}
+		c.SSDPMaxAge = maxAge
+	}
+	if v, ok := os.LookupEnv(envTimezone); ok {
+		c.Timezone = v
+	}
+	if v, ok := os.LookupEnv(envDataDir); ok {
+		c.DataDir = v
+	}
+	if v, ok := os.LookupEnv(envDeviceUUID); ok {
+		c.DeviceUUID = v
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.EPGStationURL != "" {
+		// accept bare host:port as used by EPGSTATION variable of docker-compose.yml
+		if !strings.Contains(c.EPGStationURL, "://") {
+			c.EPGStationURL = "http://" + c.EPGStationURL
+		}
+		u, err := url.Parse(c.EPGStationURL)
+		if err != nil {
+			return fmt.Errorf("config: epgstation_url: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("config: epgstation_url: unsupported scheme %q", u.Scheme)
+		}
+		if u.Host == "" {
+			return fmt.Errorf("config: epgstation_url: host is missing in %q", c.EPGStationURL)
+		}
+		c.EPGStationURL = strings.TrimSuffix(u.String(), "/")
+	}
+	if c.ListenAddress != "" && net.ParseIP(c.ListenAddress) == nil {
+		return fmt.Errorf("config: listen_address: invalid IP address %q", c.ListenAddress)
+	}
+	if c.ListenPort < 0 || c.ListenPort > 65535 {
+		return fmt.Errorf("config: listen_port: out of range %d", c.ListenPort)
+	}
+	if c.FriendlyName == "" {
+		return errors.New("config: friendly_name: must not be empty")
+	}
+	if c.RefreshInterval < time.Second {
+		return fmt.Errorf("config: refresh_interval: too short %s", c.RefreshInterval)
+	}
+	if c.CacheTTL < time.Second {
+		return fmt.Errorf("config: cache_ttl: too short %s", c.CacheTTL)
+	}
+	if c.SSDPMaxAge < 60 {
+		// UPnP Device Architecture requires max-age of at least 1800, but allow shorter for debugging
+		return fmt.Errorf("config: ssdp_max_age: too short %d", c.SSDPMaxAge)
+	}
+	location, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return fmt.Errorf("config: timezone: %w", err)
+	}
+	c.Location = location
+	if c.SeriesStrip, err = compilePatterns("series_strip_patterns", c.SeriesStripPatterns); err != nil {
+		return err
+	}
+	if c.SeriesEpisode, err = compilePatterns("series_episode_patterns", c.SeriesEpisodePatterns); err != nil {
+		return err
+	}
+	for _, re := range c.SeriesEpisode {
+		if re.NumSubexp() != 1 {
+			return fmt.Errorf("config: series_episode_patterns: %q must have one group for episode number", re)
+		}
+	}
+	for _, m := range c.StreamModes {
+		if m.Container != "mp4" && m.Container != "webm" {
+			return fmt.Errorf("config: stream_modes: unsupported container %q", m.Container)
+		}
+		if m.Mode < 0 {
+			return fmt.Errorf("config: stream_modes: negative mode %d", m.Mode)
+		}
+	}
+	if c.LiveStream.Container != "m2ts" && c.LiveStream.Container != "mp4" && c.LiveStream.Container != "webm" {
+		return fmt.Errorf("config: live_stream: unsupported container %q", c.LiveStream.Container)
+	}
+	if c.LiveStream.Mode < 0 {
+		return fmt.Errorf("config: live_stream: negative mode %d", c.LiveStream.Mode)
+	}
+	if c.DataDir == "" {
+		return errors.New("config: data_dir: must not be empty")
+	}
+	if c.DeviceUUID != "" {
+		if _, err := uuid.Parse(c.DeviceUUID); err != nil {
+			return fmt.Errorf("config: device_uuid: %w", err)
+		}
+	}
+	return nil
+}
+
+func compilePatterns(name string, patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("config: %s: %w", name, err)
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
+// EPGStationURLFor returns EPGStation base URL, falling back to EPGStation
+// running on hostIP with its default port.
+func (c *Config) EPGStationURLFor(hostIP net.IP) string {
+	if c.EPGStationURL != "" {
+		return c.EPGStationURL
+	}
+	return fmt.Sprintf("http://%s", net.JoinHostPort(hostIP.String(), strconv.Itoa(DefaultEPGStationPort)))
+}
+
+// Print writes effective configuration in the config file format.
+func (c *Config) Print(w io.Writer) {
+	if c.File != "" {
+		fmt.Fprintf(w, "# loaded from %s\n", c.File)
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		fmt.Fprintf(w, "# could not marshal config: %s\n", err)
+		return
+	}
+	w.Write(data)
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const deviceUUIDFile = "device_uuid"
+
+// LoadDeviceUUID returns UUID of this device which stays the same across
+// restarts, so that UPnP clients do not see a new MediaServer each time.
+//
+// UUID is taken from device_uuid setting if given, otherwise from the state
+// file in DataDir, which is created on first start. When DataDir is not
+// writable, UUID derived from hostname and MAC address is used instead.
+func (c *Config) LoadDeviceUUID() (uuid.UUID, error) {
+	if c.DeviceUUID != "" {
+		return uuid.Parse(c.DeviceUUID)
+	}
+
+	path := filepath.Join(c.DataDir, deviceUUIDFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		deviceUUID, err := uuid.Parse(strings.TrimSpace(string(data)))
+		if err != nil {
+			return uuid.Nil, fmt.Errorf("state file %s is broken: %w", path, err)
+		}
+		return deviceUUID, nil
+	}
+	if !os.IsNotExist(err) {
+		return uuid.Nil, err
+	}
+
+	deviceUUID := uuid.New()
+	if err := writeStateFile(path, deviceUUID.String()+"\n"); err != nil {
+		log.Printf("could not save device UUID (%s), fallback to UUID derived from host", err)
+		return hostDerivedUUID()
+	}
+	log.Printf("Generated new device UUID %s and saved to %s", deviceUUID, path)
+	return deviceUUID, nil
+}
+
+func writeStateFile(path string, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// write to temporary file then rename, not to leave half-written state file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// hostDerivedUUID returns name based UUID (version 5) from hostname and MAC
+// address of the first non-loopback interface.
+func hostDerivedUUID() (uuid.UUID, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	name := hostname
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 && len(iface.HardwareAddr) > 0 {
+			name += "/" + iface.HardwareAddr.String()
+			break
+		}
+	}
+	return uuid.NewHash(sha1.New(), uuid.NameSpaceOID, []byte("upnp-mediaserver-epgstation/"+name), 5), nil
+}
@@ -4,19 +4,35 @@
 package epgstation
 
 import (
-	"fmt"
 	"log"
-	"net"
+	"strings"
+	"sync/atomic"
 )
 
-var EPGStation *ClientWithResponses
-var ServerAPIRoot string
+type server struct {
+	client  *ClientWithResponses
+	apiRoot string
+}
+
+// current server, replaced as a whole on reload while requests are served
+var current atomic.Value // server
 
-func Setup(epgstationAddr net.TCPAddr) {
-	var err error
-	ServerAPIRoot = fmt.Sprintf("http://%s:%d/api", epgstationAddr.IP, epgstationAddr.Port)
-	EPGStation, err = NewClientWithResponses(ServerAPIRoot)
+// Setup initializes API client for EPGStation running at serverURL like http://192.168.10.10:8888
+func Setup(serverURL string) {
+	apiRoot := strings.TrimSuffix(serverURL, "/") + "/api"
+	client, err := NewClientWithResponses(apiRoot)
 	if err != nil {
 		log.Fatalf("epgstation client init error: %s", err)
 	}
+	current.Store(server{client: client, apiRoot: apiRoot})
+}
+
+// EPGStation returns API client for EPGStation set up last
+func EPGStation() *ClientWithResponses {
+	return current.Load().(server).client
+}
+
+// ServerAPIRoot returns API root URL of EPGStation set up last like http://192.168.10.10:8888/api
+func ServerAPIRoot() string {
+	return current.Load().(server).apiRoot
 }
@@ -0,0 +1,180 @@
+package epgstation
+
+import (
+	"context"
+	"fmt"
+)
+
+// PageSize is the number of items requested at once by iterators
+const PageSize = 100
+
+// An Iterator walks through every item of a paginated API, fetching the next
+// page on demand:
+//
+//	it := epgstation.IterateRecorded(ctx, epgstation.GetRecordedParams{})
+//	for it.Next() {
+//		recordedItem := it.Value()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type Iterator[T any] struct {
+	ctx   context.Context
+	fetch func(ctx context.Context, offset Offset, limit Limit) ([]T, int, error)
+
+	offset Offset
+	page   []T
+	i      int
+	total  int
+	done   bool
+	err    error
+}
+
+func newIterator[T any](ctx context.Context, fetch func(ctx context.Context, offset Offset, limit Limit) ([]T, int, error)) *Iterator[T] {
+	return &Iterator[T]{ctx: ctx, fetch: fetch, i: -1, total: -1}
+}
+
+// Next advances to the next item, fetching the next page if needed. It
+// returns false when no items are left or an error occurred.
+func (it *Iterator[T]) Next() bool {
+	if it.i+1 < len(it.page) {
+		it.i++
+		return true
+	}
+	if it.done || it.err != nil {
+		return false
+	}
+	page, total, err := it.fetch(it.ctx, it.offset, PageSize)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.offset += Offset(len(page))
+	it.total = total
+	if len(page) < PageSize || (total >= 0 && int(it.offset) >= total) {
+		it.done = true
+	}
+	it.page, it.i = page, 0
+	return len(page) > 0
+}
+
+// Value returns the current item
+func (it *Iterator[T]) Value() *T {
+	return &it.page[it.i]
+}
+
+// Err returns the error occurred on fetching pages, if any
+func (it *Iterator[T]) Err() error {
+	return it.err
+}
+
+// Total returns the total number of items reported by the last page, or -1
+// if the API does not report it or no page is fetched yet.
+func (it *Iterator[T]) Total() int {
+	return it.total
+}
+
+// All fetches every remaining item
+func (it *Iterator[T]) All() ([]T, error) {
+	var items []T
+	for it.Next() {
+		items = append(items, *it.Value())
+	}
+	return items, it.Err()
+}
+
+// IterateRecorded iterates over recordings matching params. Offset and Limit of
+// params are ignored.
+func IterateRecorded(ctx context.Context, params GetRecordedParams) *Iterator[RecordedItem] {
+	return newIterator(ctx, func(ctx context.Context, offset Offset, limit Limit) ([]RecordedItem, int, error) {
+		params.Offset, params.Limit = &offset, &limit
+		res, err := EPGStation().GetRecordedWithResponse(ctx, &params)
+		if err != nil {
+			return nil, 0, err
+		}
+		if res.JSON200 == nil {
+			return nil, 0, fmt.Errorf("GetRecorded: %s", res.Status())
+		}
+		return res.JSON200.Records, res.JSON200.Total, nil
+	})
+}
+
+// IterateRecording iterates over recordings in progress. Offset and Limit of
+// params are ignored.
+func IterateRecording(ctx context.Context, params GetRecordingParams) *Iterator[RecordedItem] {
+	return newIterator(ctx, func(ctx context.Context, offset Offset, limit Limit) ([]RecordedItem, int, error) {
+		params.Offset, params.Limit = &offset, &limit
+		res, err := EPGStation().GetRecordingWithResponse(ctx, &params)
+		if err != nil {
+			return nil, 0, err
+		}
+		if res.JSON200 == nil {
+			return nil, 0, fmt.Errorf("GetRecording: %s", res.Status())
+		}
+		return res.JSON200.Records, res.JSON200.Total, nil
+	})
+}
+
+// IterateRules iterates over rules matching params. Offset and Limit of params are
+// ignored.
+func IterateRules(ctx context.Context, params GetRulesParams) *Iterator[Rule] {
+	return newIterator(ctx, func(ctx context.Context, offset Offset, limit Limit) ([]Rule, int, error) {
+		params.Offset, params.Limit = &offset, &limit
+		res, err := EPGStation().GetRulesWithResponse(ctx, &params)
+		if err != nil {
+			return nil, 0, err
+		}
+		if res.JSON200 == nil {
+			return nil, 0, fmt.Errorf("GetRules: %s", res.Status())
+		}
+		return res.JSON200.Rules, res.JSON200.Total, nil
+	})
+}
+
+// IterateRulesKeyword iterates over keywords of rules matching params. Offset and
+// Limit of params are ignored.
+func IterateRulesKeyword(ctx context.Context, params GetRulesKeywordParams) *Iterator[RuleKeywordItem] {
+	return newIterator(ctx, func(ctx context.Context, offset Offset, limit Limit) ([]RuleKeywordItem, int, error) {
+		params.Offset, params.Limit = &offset, &limit
+		res, err := EPGStation().GetRulesKeywordWithResponse(ctx, &params)
+		if err != nil {
+			return nil, 0, err
+		}
+		if res.JSON200 == nil {
+			return nil, 0, fmt.Errorf("GetRulesKeyword: %s", res.Status())
+		}
+		// total is not reported
+		return res.JSON200.Items, -1, nil
+	})
+}
+
+// IterateReserves iterates over reserves matching params. Offset and Limit of params
+// are ignored.
+func IterateReserves(ctx context.Context, params GetReservesParams) *Iterator[ReserveItem] {
+	return newIterator(ctx, func(ctx context.Context, offset Offset, limit Limit) ([]ReserveItem, int, error) {
+		params.Offset, params.Limit = &offset, &limit
+		res, err := EPGStation().GetReservesWithResponse(ctx, &params)
+		if err != nil {
+			return nil, 0, err
+		}
+		if res.JSON200 == nil {
+			return nil, 0, fmt.Errorf("GetReserves: %s", res.Status())
+		}
+		return res.JSON200.Reserves, res.JSON200.Total, nil
+	})
+}
+
+// IterateTags iterates over recorded tags matching params. Offset and Limit of
+// params are ignored.
+func IterateTags(ctx context.Context, params GetTagsParams) *Iterator[RecordedTag] {
+	return newIterator(ctx, func(ctx context.Context, offset Offset, limit Limit) ([]RecordedTag, int, error) {
+		params.Offset, params.Limit = &offset, &limit
+		res, err := EPGStation().GetTagsWithResponse(ctx, &params)
+		if err != nil {
+			return nil, 0, err
+		}
+		if res.JSON200 == nil {
+			return nil, 0, fmt.Errorf("GetTags: %s", res.Status())
+		}
+		return res.JSON200.Tags, res.JSON200.Total, nil
+	})
+}
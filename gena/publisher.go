@@ -0,0 +1,217 @@
+// Package gena implements publisher side of General Event Notification
+// Architecture (GENA) described in UPnP Device Architecture 1.0, section 4.
+package gena
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	methodSubscribe   = "SUBSCRIBE"
+	methodUnsubscribe = "UNSUBSCRIBE"
+	serverName        = "Linux/i686 UPnP/1.0 go-upnp-playground/0.0.1"
+
+	// DefaultTimeout is used when subscriber requests infinite or too long subscription
+	DefaultTimeout = 1800 * time.Second
+	// MinTimeout prevents subscribers from flooding with renewals
+	MinTimeout = 60 * time.Second
+)
+
+var (
+	callbackRegexp = regexp.MustCompile(`<([^>]+)>`)
+	timeoutRegexp  = regexp.MustCompile(`(?i)^Second-(\d+)$`)
+)
+
+// A Property is an evented state variable and its value
+type Property struct {
+	Name  string
+	Value string
+}
+
+// A Publisher manages subscriptions to one service and delivers event
+// messages to their callback URLs.
+type Publisher struct {
+	mu            sync.Mutex
+	subscriptions map[string]*subscription
+	// returns all evented state variables to be sent as initial event message
+	initialState func() []Property
+}
+
+func NewPublisher(initialState func() []Property) *Publisher {
+	return &Publisher{
+		subscriptions: make(map[string]*subscription),
+		initialState:  initialState,
+	}
+}
+
+// ServeHTTP handles SUBSCRIBE and UNSUBSCRIBE requests on eventSubURL
+func (p *Publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case methodSubscribe:
+		if r.Header.Get("SID") != "" {
+			p.renew(w, r)
+		} else {
+			p.subscribe(w, r)
+		}
+	case methodUnsubscribe:
+		p.unsubscribe(w, r)
+	default:
+		w.Header().Set("Allow", methodSubscribe+", "+methodUnsubscribe)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func parseCallbacks(header string) []*url.URL {
+	var callbacks []*url.URL
+	for _, m := range callbackRegexp.FindAllStringSubmatch(header, -1) {
+		u, err := url.Parse(m[1])
+		if err != nil || u.Scheme != "http" {
+			continue
+		}
+		callbacks = append(callbacks, u)
+	}
+	return callbacks
+}
+
+func parseTimeout(header string) time.Duration {
+	m := timeoutRegexp.FindStringSubmatch(strings.TrimSpace(header))
+	if m == nil {
+		// "infinite" or missing
+		return DefaultTimeout
+	}
+	seconds, err := strconv.Atoi(m[1])
+	if err != nil {
+		return DefaultTimeout
+	}
+	timeout := time.Duration(seconds) * time.Second
+	if timeout < MinTimeout {
+		return MinTimeout
+	}
+	if timeout > DefaultTimeout {
+		return DefaultTimeout
+	}
+	return timeout
+}
+
+func writeSubscribeResponse(w http.ResponseWriter, s *subscription, timeout time.Duration) {
+	h := w.Header()
+	h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	h.Set("Server", serverName)
+	h.Set("SID", s.sid)
+	h.Set("Timeout", fmt.Sprintf("Second-%d", int(timeout/time.Second)))
+	h.Set("Content-Length", "0")
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (p *Publisher) subscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("NT") != "upnp:event" {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	callbacks := parseCallbacks(r.Header.Get("Callback"))
+	if len(callbacks) == 0 {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	timeout := parseTimeout(r.Header.Get("Timeout"))
+	s := newSubscription("uuid:"+uuid.New().String(), callbacks, time.Now().Add(timeout))
+	// initial event message takes SEQ 0, before any event notified once published
+	s.enqueue(p.initialState())
+
+	p.mu.Lock()
+	p.purgeExpiredLocked()
+	p.subscriptions[s.sid] = s
+	p.mu.Unlock()
+
+	log.Printf("GENA: subscribed %s by %s (timeout %s)", s.sid, callbacks[0], timeout)
+	writeSubscribeResponse(w, s, timeout)
+	// initial event message must be sent after the response to SUBSCRIBE
+	s.start()
+}
+
+func (p *Publisher) renew(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("NT") != "" || r.Header.Get("Callback") != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	timeout := parseTimeout(r.Header.Get("Timeout"))
+
+	p.mu.Lock()
+	p.purgeExpiredLocked()
+	s, ok := p.subscriptions[r.Header.Get("SID")]
+	if ok {
+		s.setExpires(time.Now().Add(timeout))
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	writeSubscribeResponse(w, s, timeout)
+}
+
+func (p *Publisher) unsubscribe(w http.ResponseWriter, r *http.Request) {
+	sid := r.Header.Get("SID")
+	if sid == "" || r.Header.Get("NT") != "" || r.Header.Get("Callback") != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	s, ok := p.subscriptions[sid]
+	delete(p.subscriptions, sid)
+	p.mu.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	s.close()
+	log.Printf("GENA: unsubscribed %s", sid)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (p *Publisher) purgeExpiredLocked() {
+	now := time.Now()
+	for sid, s := range p.subscriptions {
+		if s.expired(now) {
+			delete(p.subscriptions, sid)
+			s.close()
+			log.Printf("GENA: subscription %s expired", sid)
+		}
+	}
+}
+
+// Notify sends event message with properties to every active subscriber
+func (p *Publisher) Notify(properties ...Property) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.purgeExpiredLocked()
+	for _, s := range p.subscriptions {
+		s.enqueue(properties)
+	}
+}
+
+// Close cancels every subscription
+func (p *Publisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for sid, s := range p.subscriptions {
+		delete(p.subscriptions, sid)
+		s.close()
+	}
+}
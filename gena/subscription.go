@@ -0,0 +1,168 @@
+package gena
+
+import (
+	"bytes"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"upnp-mediaserver/bufferpool"
+)
+
+const (
+	methodNotify = "NOTIFY"
+	// event messages queued more than this for a subscriber are dropped
+	queueSize     = 16
+	notifyTimeout = 5 * time.Second
+)
+
+var notifyClient = &http.Client{Timeout: notifyTimeout}
+
+type subscription struct {
+	sid       string
+	callbacks []*url.URL
+
+	mu      sync.Mutex
+	expires time.Time
+	closed  bool
+
+	// event messages are delivered one by one in SEQ order by deliver goroutine
+	queue chan []Property
+	// closed by start, as no event message may precede the response to SUBSCRIBE
+	ready     chan struct{}
+	startOnce sync.Once
+	// SEQ header value, starts from 0 for initial event message
+	seq uint32
+}
+
+func newSubscription(sid string, callbacks []*url.URL, expires time.Time) *subscription {
+	s := &subscription{
+		sid:       sid,
+		callbacks: callbacks,
+		expires:   expires,
+		queue:     make(chan []Property, queueSize),
+		ready:     make(chan struct{}),
+	}
+	go s.deliver()
+	return s
+}
+
+// start lets event messages enqueued so far and later be delivered
+func (s *subscription) start() {
+	s.startOnce.Do(func() { close(s.ready) })
+}
+
+func (s *subscription) setExpires(expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expires = expires
+}
+
+func (s *subscription) expired(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return now.After(s.expires)
+}
+
+func (s *subscription) enqueue(properties []Property) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- properties:
+	default:
+		log.Printf("GENA: event queue of %s is full, event dropped", s.sid)
+	}
+}
+
+func (s *subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	// not to leave deliver goroutine waiting
+	s.start()
+}
+
+func (s *subscription) deliver() {
+	<-s.ready
+	for properties := range s.queue {
+		s.notify(properties)
+		// SEQ wraps to 1, as 0 is reserved for initial event message
+		if s.seq == ^uint32(0) {
+			s.seq = 1
+		} else {
+			s.seq++
+		}
+	}
+}
+
+type propertySet struct {
+	XMLName    xml.Name `xml:"e:propertyset"`
+	XMLNS      string   `xml:"xmlns:e,attr"`
+	Properties []property
+}
+
+type property struct {
+	XMLName  xml.Name `xml:"e:property"`
+	Variable struct {
+		XMLName xml.Name
+		Value   string `xml:",chardata"`
+	}
+}
+
+func marshalPropertySet(properties []Property) ([]byte, error) {
+	set := propertySet{XMLNS: "urn:schemas-upnp-org:event-1-0"}
+	for _, p := range properties {
+		var prop property
+		prop.Variable.XMLName.Local = p.Name
+		prop.Variable.Value = p.Value
+		set.Properties = append(set.Properties, prop)
+	}
+	buf := bufferpool.NewBytesBuffer()
+	defer bufferpool.PutBytesBuffer(buf)
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(buf).Encode(set); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// notify sends event message to callback URLs in order until one succeeds
+func (s *subscription) notify(properties []Property) {
+	body, err := marshalPropertySet(properties)
+	if err != nil {
+		log.Printf("GENA: could not marshal event message: %s", err)
+		return
+	}
+	for _, callback := range s.callbacks {
+		req, err := http.NewRequest(methodNotify, callback.String(), bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+		// Putting headers in here avoids them being title-cased.
+		req.Header["NT"] = []string{"upnp:event"}
+		req.Header["NTS"] = []string{"upnp:propchange"}
+		req.Header["SID"] = []string{s.sid}
+		req.Header["SEQ"] = []string{strconv.FormatUint(uint64(s.seq), 10)}
+		res, err := notifyClient.Do(req)
+		if err != nil {
+			log.Printf("GENA: NOTIFY to %s failed: %s", callback, err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			return
+		}
+		log.Printf("GENA: NOTIFY to %s responded %s", callback, res.Status)
+	}
+}
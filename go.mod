@@ -5,4 +5,5 @@ go 1.18
 require (
 	github.com/deepmap/oapi-codegen v1.10.1
 	github.com/google/uuid v1.3.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -1,18 +1,19 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"upnp-mediaserver/config"
 	"upnp-mediaserver/service"
 	"upnp-mediaserver/ssdp"
 	"log"
 	"net"
+	"time"
 
 	"os"
 	"os/signal"
 	"syscall"
-
-	"github.com/google/uuid"
 )
 
 func localIP() (net.IP, error) {
@@ -29,48 +30,112 @@ func localIP() (net.IP, error) {
 	return nil, errors.New("could not get local IP address")
 }
 
+func hostIP(cfg *config.Config) (net.IP, error) {
+	if cfg.ListenAddress != "" {
+		return net.ParseIP(cfg.ListenAddress), nil
+	}
+	return localIP()
+}
+
+// time to wait for in-flight requests on shutdown before closing them forcibly
+const shutdownTimeout = 10 * time.Second
+
 func main() {
-	deviceUUID := uuid.New()
-	localIP, err := localIP()
-	server := service.NewServer(deviceUUID, localIP)
+	os.Exit(run())
+}
+
+// run serves until SIGINT or SIGTERM and returns exit code. SIGHUP reloads
+// configuration and rebuilds the content tree.
+func run() int {
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Println("Effective configuration:")
+	cfg.Print(log.Writer())
+
+	deviceUUID, err := cfg.LoadDeviceUUID()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Device UUID: ", deviceUUID)
+	hostIP, err := hostIP(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := service.NewServer(deviceUUID, hostIP, cfg)
 
 	server.Listen()
 	log.Println("Listening: ", service.URLBase)
 	server.Setup()
 
-	errSrv := make(chan error)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errc := make(chan error, 3)
 	go func() {
-		errSrv <- server.Serve()
+		errc <- fmt.Errorf("http: %w", server.Serve())
 	}()
+	go server.Watch(ctx)
 
-	ssdpadv := ssdp.NewSSDPAdvertiser(deviceUUID, service.URLBase)
-	ssdpres := ssdp.NewSSDPDiscoveryResponder(deviceUUID, service.URLBase)
-
-	errSsdpRes := make(chan error)
-	errSsdpAdvRes := make(chan error)
-
+	ssdpadv := ssdp.NewSSDPAdvertiser(deviceUUID, service.URLBase, cfg.SSDPMaxAge)
+	ssdpres := ssdp.NewSSDPDiscoveryResponder(deviceUUID, service.URLBase, cfg.SSDPMaxAge)
 	go func() {
-		errSsdpRes <- ssdpres.ListenAndServe()
+		errc <- fmt.Errorf("ssdp responder: %w", ssdpres.ListenAndServe())
 	}()
 	go func() {
-		errSsdpAdvRes <- ssdpadv.Serve()
+		errc <- fmt.Errorf("ssdp advertiser: %w", ssdpadv.Serve(ctx))
 	}()
 
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		ssdpadv.NotifyByebye()
-		os.Exit(1)
-	}()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigc)
 
-	msgSrv := <-errSrv
-	fmt.Println(msgSrv)
-	msgSsdpRes := <-errSsdpRes
-	fmt.Println(msgSsdpRes)
-	msgSsdpAdvRes := <-errSsdpAdvRes
-	fmt.Println(msgSsdpAdvRes)
+	reloading := make(chan struct{}, 1)
+	exitCode := 0
+loop:
+	for {
+		select {
+		case sig := <-sigc:
+			if sig != syscall.SIGHUP {
+				log.Printf("Received %s, shutting down", sig)
+				break loop
+			}
+			select {
+			case reloading <- struct{}{}:
+			default:
+				log.Println("Received SIGHUP, but reload is already in progress")
+				continue
+			}
+			log.Println("Received SIGHUP, reloading")
+			go func() {
+				defer func() { <-reloading }()
+				newCfg, err := config.Load(os.Args[1:])
+				if err != nil {
+					log.Printf("Reload failed, keep current configuration: %s", err)
+					return
+				}
+				log.Println("Effective configuration:")
+				newCfg.Print(log.Writer())
+				server.Reload(newCfg)
+				ssdpadv.NotifyAlive()
+				log.Println("Reload complete")
+			}()
+		case err := <-errc:
+			log.Print(err)
+			exitCode = 1
+			break loop
+		}
+	}
+
+	cancel()
+	ssdpadv.NotifyByebye()
+	ssdpres.Close()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown: %s", err)
+	}
+	log.Println("Stopped")
+	return exitCode
 }
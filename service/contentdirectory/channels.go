@@ -0,0 +1,67 @@
+package contentdirectory
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"upnp-mediaserver/epgstation"
+)
+
+// channels caches channels of EPGStation, which rarely change
+var channels struct {
+	sync.RWMutex
+	items []epgstation.ChannelItem
+	byId  map[epgstation.ChannelId]epgstation.ChannelItem
+}
+
+// getChannels returns channels in the order of EPGStation, fetching them
+// if not yet
+func getChannels(ctx context.Context) ([]epgstation.ChannelItem, error) {
+	channels.RLock()
+	items := channels.items
+	channels.RUnlock()
+	if items != nil {
+		return items, nil
+	}
+
+	res, err := epgstation.EPGStation().GetChannelsWithResponse(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if res.JSON200 == nil {
+		return nil, fmt.Errorf("GetChannels: %s", res.Status())
+	}
+	items = *res.JSON200
+	byId := make(map[epgstation.ChannelId]epgstation.ChannelItem)
+	for _, channelItem := range items {
+		byId[channelItem.Id] = channelItem
+	}
+	channels.Lock()
+	channels.items, channels.byId = items, byId
+	channels.Unlock()
+	return items, nil
+}
+
+// prepareChannels fetches channels if not yet, for items to show names of
+// channels. Items are listed without them when fetching fails.
+func prepareChannels(ctx context.Context) {
+	if _, err := getChannels(ctx); err != nil {
+		log.Printf("Fetching channels failed: %s", err)
+	}
+}
+
+// channelItem returns the channel of id, if fetched already
+func channelItem(id epgstation.ChannelId) (epgstation.ChannelItem, bool) {
+	channels.RLock()
+	defer channels.RUnlock()
+	channelItem, ok := channels.byId[id]
+	return channelItem, ok
+}
+
+// resetChannels makes channels fetched again on next use
+func resetChannels() {
+	channels.Lock()
+	channels.items, channels.byId = nil, nil
+	channels.Unlock()
+}
@@ -2,16 +2,22 @@ package contentdirectory
 
 import (
 	"context"
-	"encoding/xml"
+	"errors"
 	"fmt"
-	"upnp-mediaserver/epgstation"
 	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"upnp-mediaserver/config"
+	"upnp-mediaserver/epgstation"
 )
 
 var serviceURLBase string
-var videoFileIdDurationMap map[epgstation.VideoFileId]time.Duration
-var lastRecordedTotal int
+var refreshInterval int64 // time.Duration, accessed atomically
+var location atomic.Value // *time.Location
 
 var genreIdNameMap = map[epgstation.ProgramGenreLv1]string{
 	0x0: "ニュース・報道",
@@ -32,199 +38,478 @@ var genreIdNameMap = map[epgstation.ProgramGenreLv1]string{
 	0xf: "その他",
 }
 
-func watchEPGStationForSetup() {
+// Configure applies settings of cfg. The refresh interval takes effect from
+// the next poll of Watch, and the others on containers resolved after, so
+// Rebuild to apply them to every container.
+func Configure(cfg *config.Config) {
+	atomic.StoreInt64(&refreshInterval, int64(cfg.RefreshInterval))
+	setCacheTTL(cfg.CacheTTL)
+	location.Store(cfg.Location)
+	setSeriesRules(cfg.SeriesStrip, cfg.SeriesEpisode)
+	streamModes.Store(cfg.StreamModes)
+	liveStream.Store(cfg.LiveStream)
+}
+
+// currentLocation returns the time zone of dates, JST unless set
+func currentLocation() *time.Location {
+	if loc, _ := location.Load().(*time.Location); loc != nil {
+		return loc
+	}
+	return JST
+}
+
+// Watch polls EPGStation every refresh interval and invalidates containers
+// listing recordings changed, until ctx is done.
+func Watch(ctx context.Context) {
 	for {
-		time.Sleep(1 * time.Minute)
-		res, err := epgstation.EPGStation.GetRecordedWithResponse(context.Background(), &epgstation.GetRecordedParams{
-			IsHalfWidth: false,
-		})
-		if err == nil && res.JSON200.Total != lastRecordedTotal {
-			Setup(serviceURLBase)
+		// the first refresh takes the baseline to compare with
+		if _, err := refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Refresh ContentDirectory failed: %s", err)
+		}
+		expireLive()
+		timer := time.NewTimer(time.Duration(atomic.LoadInt64(&refreshInterval)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
 		}
 	}
 }
 
+// Setup builds the top of the content tree. Containers are resolved from
+// EPGStation on first access, so run Watch to keep them in sync.
 func Setup(ServiceURLBase string) {
-	log.Println("Setup ContentDirectory start")
 	serviceURLBase = ServiceURLBase
+	registry.Lock()
+	newTree()
+	registry.Unlock()
+}
 
-	rootContainer := NewContainer("0", nil, "Root")
-	log.Println("Setup Recorded Container")
-	recordedContainer := setupRecordedContainer(rootContainer)
-	log.Println("Setup Genres Container")
-	setupGenresContainer(rootContainer)
-	log.Println("Setup Channels Container")
-	setupChannelsContainer(rootContainer)
-	log.Println("Setup Rules Container")
-	setupRulesContainer(rootContainer)
+// Rebuild discards every container resolved so far, so that they are fetched
+// again from EPGStation on next access.
+func Rebuild() {
+	refreshMu.Lock()
+	recordings = nil
+	refreshMu.Unlock()
+	resetChannels()
+	registry.Lock()
+	ids := newTree()
+	registry.Unlock()
+	notifyUpdated(ids...)
+	log.Println("Rebuild ContentDirectory")
+}
 
-	log.Printf("Setup ContentDirectory complete. %d items found", recordedContainer.ChildCount)
+// Object IDs are paths from the root like "genres/7/123", made of kind of
+// top level container, key of category and recorded id, so that clients can
+// keep them across restarts and an item in several containers has distinct
+// IDs.
+const (
+	recordedContainerID  = ObjectID("recorded")
+	genresContainerID    = ObjectID("genres")
+	channelsContainerID  = ObjectID("channels")
+	rulesContainerID     = ObjectID("rules")
+	datesContainerID     = ObjectID("dates")
+	weekdaysContainerID  = ObjectID("weekdays")
+	tagsContainerID      = ObjectID("tags")
+	recordingContainerID = ObjectID("recording")
+	seriesContainerID    = ObjectID("series")
+	liveContainerID      = ObjectID("live")
+)
 
-	go watchEPGStationForSetup()
+// childID returns ID of the child identified by key in container parentID
+func childID(parentID ObjectID, key interface{}) ObjectID {
+	return ObjectID(fmt.Sprintf("%s/%v", parentID, key))
 }
 
-func setupRecordedContainer(parent *Container) *Container {
-	recordedContainer := NewContainer("01", parent, "録画済み")
-	res, err := epgstation.EPGStation.GetRecordedWithResponse(context.Background(), &epgstation.GetRecordedParams{
-		IsHalfWidth: false,
-	})
-	if err != nil {
-		log.Fatal(err)
+// parentIDOf returns ID of the container having object id, as childID builds
+func parentIDOf(id ObjectID) ObjectID {
+	i := strings.LastIndex(string(id), "/")
+	if i < 0 {
+		return "0"
 	}
-	lastRecordedTotal = res.JSON200.Total
-	videoFileIdDurationMap = make(map[epgstation.VideoFileId]time.Duration)
-	for _, recordedItem := range res.JSON200.Records {
-		for _, videoFile := range *recordedItem.VideoFiles {
-			res, err := epgstation.EPGStation.GetVideosVideoFileIdDurationWithResponse(context.Background(), epgstation.PathVideoFileId(videoFile.Id))
-			if err != nil {
-				log.Fatal(err)
-			}
-			if res.JSONDefault != nil {
-				// Some videoFile may deleted from filesystem manually.  In such case, EPGstation returns error 
-				log.Printf("Error (code: %d %s): %s", res.JSONDefault.Code, res.JSONDefault.Message, *res.JSONDefault.Errors)
-				continue
-			}
-			videoFileIdDurationMap[videoFile.Id] = time.Duration(res.JSON200.Duration * float32(time.Second))
+	return id[:i]
+}
+
+func genreContainerID(genre epgstation.ProgramGenreLv1) ObjectID {
+	return childID(genresContainerID, int(genre))
+}
+
+func channelContainerID(channelId epgstation.ChannelId) ObjectID {
+	return childID(channelsContainerID, int(channelId))
+}
+
+func ruleContainerID(ruleId epgstation.RuleId) ObjectID {
+	return childID(rulesContainerID, int(ruleId))
+}
+
+// newTree discards every object and builds root and top level containers.
+// It returns IDs of them. Caller must hold the write lock of registry.
+func newTree() []ObjectID {
+	registry.reset()
+	root := NewContainer("0", nil, "Root")
+	ids := []ObjectID{root.Id}
+	rules := newLazyContainer(rulesContainerID, root.Id, "ルール別", loadRules, -1)
+	// not resolved searching from root, as listing rules asks EPGStation for
+	// each rule, and their recordings are in 録画済み anyway
+	rules.subset = true
+	for _, c := range []*Container{
+		newLazyContainer(recordedContainerID, root.Id, "録画済み", loadRecorded, -1),
+		newLazyContainer(genresContainerID, root.Id, "ジャンル別", loadGenres, -1),
+		newLazyContainer(channelsContainerID, root.Id, "チャンネル別", loadChannels, -1),
+		rules,
+		newLazyContainer(datesContainerID, root.Id, "日付別", loadYears, -1),
+		newLazyContainer(weekdaysContainerID, root.Id, "曜日別", loadWeekdays, -1),
+		newLazyContainer(tagsContainerID, root.Id, "タグ別", loadTags, -1),
+		newLazyContainer(recordingContainerID, root.Id, "録画中", loadRecording, -1),
+		newLazyContainer(seriesContainerID, root.Id, "シリーズ別", loadSeries, -1),
+		newLazyContainer(liveContainerID, root.Id, "ライブ", loadLive, -1),
+	} {
+		root.AppendContainer(c)
+		ids = append(ids, c.Id)
+	}
+	return ids
+}
+
+// recordedItems fetches recordings matching params as items under parentID.
+// Recordings in progress are listed in 録画中 instead.
+func recordedItems(ctx context.Context, parentID ObjectID, params epgstation.GetRecordedParams) ([]interface{}, error) {
+	prepareChannels(ctx)
+	var items []interface{}
+	it := epgstation.IterateRecorded(ctx, params)
+	for it.Next() {
+		if it.Value().IsRecording {
+			continue
 		}
+		items = append(items, NewItem(parentID, it.Value()))
 	}
-	for _, recordedItem := range res.JSON200.Records {
-		NewItem(recordedContainer, &recordedItem, videoFileIdDurationMap)
+	return items, it.Err()
+}
+
+func loadRecording(ctx context.Context, container *Container) ([]interface{}, error) {
+	prepareChannels(ctx)
+	var items []interface{}
+	it := epgstation.IterateRecording(ctx, epgstation.GetRecordingParams{})
+	for it.Next() {
+		items = append(items, NewItem(container.Id, it.Value()))
 	}
-	return recordedContainer
+	return items, it.Err()
 }
 
-func setupGenresContainer(parent *Container) *Container {
-	genresContainer := NewContainer("02", parent, "ジャンル別")
-	res, err := epgstation.EPGStation.GetRecordedOptionsWithResponse(context.Background())
+func loadRecorded(ctx context.Context, container *Container) ([]interface{}, error) {
+	return recordedItems(ctx, container.Id, epgstation.GetRecordedParams{})
+}
+
+func recordedOptions(ctx context.Context) (*epgstation.RecordedSearchOptions, error) {
+	res, err := epgstation.EPGStation().GetRecordedOptionsWithResponse(ctx)
 	if err != nil {
-		log.Fatal(err)
-	}
-	for _, genre := range res.JSON200.Genres {
-		genreContainer := NewContainer(ObjectID(fmt.Sprintf("02%d", int(genre.Genre))), genresContainer, genreIdNameMap[genre.Genre])
-		genre := epgstation.QueryProgramGenre(genre.Genre)
-		res, err := epgstation.EPGStation.GetRecordedWithResponse(context.Background(), &epgstation.GetRecordedParams{
-			IsHalfWidth: true,
-			Genre:       &genre,
-		})
-		if err != nil {
-			log.Fatal(err)
-		}
-		for _, recordedItem := range res.JSON200.Records {
-			NewItem(genreContainer, &recordedItem, videoFileIdDurationMap)
-		}
+		return nil, err
+	}
+	if res.JSON200 == nil {
+		return nil, fmt.Errorf("GetRecordedOptions: %s", res.Status())
 	}
-	return genresContainer
+	return res.JSON200, nil
 }
 
-func setupChannelsContainer(parent *Container) *Container {
-	channelsContainer := NewContainer("03", parent, "チャンネル別")
-	resChannelInfo, err := epgstation.EPGStation.GetChannelsWithResponse(context.Background())
+func loadChannels(ctx context.Context, container *Container) ([]interface{}, error) {
+	options, err := recordedOptions(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	channelIdChannelItemMap := make(map[epgstation.ChannelId]epgstation.ChannelItem)
-	for _, channelItem := range *resChannelInfo.JSON200 {
-		channelIdChannelItemMap[channelItem.Id] = channelItem
+	counts := make(map[epgstation.ChannelId]int)
+	for _, c := range options.Channels {
+		counts[c.ChannelId] = c.Cnt
 	}
-
-	res, err := epgstation.EPGStation.GetRecordedOptionsWithResponse(context.Background())
+	channelItems, err := getChannels(ctx)
 	if err != nil {
-		log.Fatal(err)
-	}
-	for _, channel := range res.JSON200.Channels {
-		channelName := channelIdChannelItemMap[channel.ChannelId].HalfWidthName
-		channelContainer := NewContainer(ObjectID(fmt.Sprintf("03%d", int(channel.ChannelId))), channelsContainer, channelName)
-		queryChannelId := epgstation.QueryChannelId(channel.ChannelId)
-		res, err := epgstation.EPGStation.GetRecordedWithResponse(context.Background(), &epgstation.GetRecordedParams{
-			IsHalfWidth: false,
-			ChannelId:   &queryChannelId,
-		})
-		if err != nil {
-			log.Fatal(err)
-		}
-		for _, recordedItem := range res.JSON200.Records {
-			NewItem(channelContainer, &recordedItem, videoFileIdDurationMap)
+		return nil, err
+	}
+	var children []interface{}
+	// in the order of EPGStation
+	for _, channelItem := range channelItems {
+		cnt, ok := counts[channelItem.Id]
+		if !ok {
+			continue
 		}
+		channelId := epgstation.QueryChannelId(channelItem.Id)
+		child := newLazyContainer(channelContainerID(channelItem.Id), container.Id, channelItem.HalfWidthName, func(ctx context.Context, container *Container) ([]interface{}, error) {
+			return recordedItems(ctx, container.Id, epgstation.GetRecordedParams{ChannelId: &channelId})
+		}, cnt)
+		child.subset = true
+		children = append(children, child)
 	}
-	return channelsContainer
+	return children, nil
 }
 
-func setupRulesContainer(parent *Container) *Container {
-	rulesContainer := NewContainer("04", parent, "ルール別")
-	resRulesInfo, err := epgstation.EPGStation.GetRulesKeywordWithResponse(context.Background(), &epgstation.GetRulesKeywordParams{})
+func loadRules(ctx context.Context, container *Container) ([]interface{}, error) {
+	rules, err := epgstation.IterateRulesKeyword(ctx, epgstation.GetRulesKeywordParams{}).All()
 	if err != nil {
-		log.Fatal(err)
-	}
-	for _, ruleItem := range resRulesInfo.JSON200.Items {
-		queryRuleId := epgstation.QueryRuleId(ruleItem.Id)
-		res, err := epgstation.EPGStation.GetRecordedWithResponse(context.Background(), &epgstation.GetRecordedParams{
-			IsHalfWidth: false,
-			RuleId:      &queryRuleId,
-		})
+		return nil, err
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Id < rules[j].Id })
+	var children []interface{}
+	for _, rule := range rules {
+		ruleId := epgstation.QueryRuleId(rule.Id)
+		// the list of rules has no number of recordings
+		limit := epgstation.Limit(1)
+		res, err := epgstation.EPGStation().GetRecordedWithResponse(ctx, &epgstation.GetRecordedParams{RuleId: &ruleId, Limit: &limit})
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		if res.JSON200.Total > 0 {
-			ruleContainer := NewContainer(ObjectID(fmt.Sprintf("04%d", int(ruleItem.Id))), rulesContainer, ruleItem.Keyword)
-			for _, recordedItem := range res.JSON200.Records {
-				NewItem(ruleContainer, &recordedItem, videoFileIdDurationMap)
-			}
+		if res.JSON200 == nil {
+			return nil, fmt.Errorf("GetRecorded: %s", res.Status())
+		}
+		if res.JSON200.Total == 0 {
+			continue
 		}
+		child := newLazyContainer(ruleContainerID(rule.Id), container.Id, rule.Keyword, func(ctx context.Context, container *Container) ([]interface{}, error) {
+			return recordedItems(ctx, container.Id, epgstation.GetRecordedParams{RuleId: &ruleId})
+		}, res.JSON200.Total)
+		child.subset = true
+		children = append(children, child)
 	}
-	return rulesContainer
+	return children, nil
 }
 
-func GetRecordedTotal() int {
-	res, err := epgstation.EPGStation.GetRecordedWithResponse(context.Background(), &epgstation.GetRecordedParams{
-		IsHalfWidth: false,
-	})
-	if err != nil {
-		log.Fatal(err)
+var ErrNoSuchObject = errors.New("no such object")
+
+func MarshalMetadata(ctx context.Context, objectID string, filter string) (string, error) {
+	if err := resolvePath(ctx, ObjectID(objectID)); err != nil {
+		return "", err
+	}
+	registry.RLock()
+	defer registry.RUnlock()
+	object, ok := registry.object(ObjectID(objectID))
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrNoSuchObject, objectID)
 	}
-	return res.JSON200.Total
+	return marshalDIDLLite([]interface{}{object}, ParseFilter(filter))
 }
 
-func MarshalMetadata(objectID string) string {
-	object := registory[ObjectID(objectID)]
-	wrapper := DIDLLite{}
-	wrapper.Objects = append(wrapper.Objects, &object)
-	data, err := xml.Marshal(wrapper)
-	if err != nil {
-		log.Fatal(err)
+// paginate returns range of slice to return for StartingIndex and RequestedCount.
+// RequestedCount 0 means all objects from StartingIndex.
+func paginate(total int, StartingIndex int, RequestedCount int) (int, int) {
+	start := StartingIndex
+	if start > total {
+		start = total
+	}
+	end := total
+	if RequestedCount > 0 && RequestedCount < total-start {
+		end = start + RequestedCount
 	}
-	return string(data)
+	return start, end
 }
 
-func MarshalDirectChildren(objectID string, StartingIndex int, RequestedCount int) string {
-	object := registory[ObjectID(objectID)]
-	container, ok := object.(*Container)
+// MarshalDirectChildren returns DIDL-Lite of children of objectID, with
+// NumberReturned and TotalMatches
+func MarshalDirectChildren(ctx context.Context, objectID string, filter string, SortCriteria string, StartingIndex int, RequestedCount int) (string, int, int, error) {
+	if err := resolvePath(ctx, ObjectID(objectID)); err != nil {
+		return "", 0, 0, err
+	}
+	if err := resolve(ctx, ObjectID(objectID)); err != nil {
+		return "", 0, 0, err
+	}
+	registry.RLock()
+	defer registry.RUnlock()
+	object, ok := registry.object(ObjectID(objectID))
 	if !ok {
-		log.Fatalf("passed objectID %s not found as a container", objectID)
-	}
-	wrapper := DIDLLite{}
-	var min, max int
-	if StartingIndex < cap(container.Children) {
-		min = StartingIndex
-	} else {
-		min = cap(container.Children)
-	}
-	if StartingIndex+RequestedCount <= cap(container.Children) {
-		max = StartingIndex + RequestedCount
-	} else {
-		max = cap(container.Children)
-	}
-	wrapper.Objects = container.Children[min:max]
-	data, err := xml.Marshal(wrapper)
+		return "", 0, 0, fmt.Errorf("%w: %s", ErrNoSuchObject, objectID)
+	}
+	var children []interface{}
+	if container, ok := object.(*Container); ok {
+		// an item has no children
+		children = container.Children
+	}
+	children, err := sortObjects(children, SortCriteria)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	start, end := paginate(len(children), StartingIndex, RequestedCount)
+	result, err := marshalDIDLLite(children[start:end], ParseFilter(filter))
 	if err != nil {
-		log.Fatal(err)
+		return "", 0, 0, err
+	}
+	return result, end - start, len(children), nil
+}
+
+// GetObject returns the object of objectID. The object must not be modified,
+// and children of a container must not be read, as the tree may be updated
+// concurrently.
+func GetObject(objectID string) (interface{}, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	object, ok := registry.object(ObjectID(objectID))
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchObject, objectID)
+	}
+	return object, nil
+}
+
+// ErrNoSuchResource is returned when EPGStation does not know a video file
+var ErrNoSuchResource = errors.New("no such resource")
+
+// how long video files unknown to EPGStation are remembered, so that stale
+// URLs of clients are not asked again and again
+const missingResourceTTL = 30 * time.Second
+
+// resourceLookups collapses concurrent lookups of the same video file not
+// listed in the content tree, and remembers ones EPGStation does not know
+var resourceLookups = struct {
+	sync.Mutex
+	pending map[epgstation.VideoFileId]*resourceLookup
+	missing map[epgstation.VideoFileId]time.Time
+}{
+	pending: make(map[epgstation.VideoFileId]*resourceLookup),
+	missing: make(map[epgstation.VideoFileId]time.Time),
+}
+
+type resourceLookup struct {
+	done     chan struct{}
+	resource *Resource
+	err      error
+}
+
+// LookupResource returns the resource of videoFileId. Resources not listed in
+// the content tree yet, as after restart, are fetched from EPGStation, since
+// clients keep URLs of resources browsed before.
+func LookupResource(ctx context.Context, videoFileId epgstation.VideoFileId) (*Resource, error) {
+	registry.RLock()
+	resource, ok := registry.resource(videoFileId)
+	registry.RUnlock()
+	if ok {
+		return resource, nil
+	}
+
+	resourceLookups.Lock()
+	if expiry, ok := resourceLookups.missing[videoFileId]; ok && time.Now().Before(expiry) {
+		resourceLookups.Unlock()
+		return nil, fmt.Errorf("%w: video file %d", ErrNoSuchResource, videoFileId)
+	}
+	if lookup, ok := resourceLookups.pending[videoFileId]; ok {
+		resourceLookups.Unlock()
+		select {
+		case <-lookup.done:
+			return lookup.resource, lookup.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	lookup := &resourceLookup{done: make(chan struct{})}
+	resourceLookups.pending[videoFileId] = lookup
+	resourceLookups.Unlock()
+
+	lookup.resource, lookup.err = fetchResource(ctx, videoFileId)
+	if lookup.err == nil {
+		registry.Lock()
+		if registered, ok := registry.resource(videoFileId); ok {
+			lookup.resource = registered
+		} else {
+			registry.resources[videoFileId] = lookup.resource
+		}
+		registry.Unlock()
+	}
+
+	resourceLookups.Lock()
+	delete(resourceLookups.pending, videoFileId)
+	if errors.Is(lookup.err, ErrNoSuchResource) {
+		now := time.Now()
+		for id, expiry := range resourceLookups.missing {
+			if now.After(expiry) {
+				delete(resourceLookups.missing, id)
+			}
+		}
+		resourceLookups.missing[videoFileId] = now.Add(missingResourceTTL)
 	}
-	return string(data)
+	resourceLookups.Unlock()
+	close(lookup.done)
+	return lookup.resource, lookup.err
 }
 
-func GetObject(objectID string) interface{} {
-	return registory[ObjectID(objectID)]
+// fetchResource finds the recording of videoFileId on EPGStation and returns
+// the resource of the video file
+func fetchResource(ctx context.Context, videoFileId epgstation.VideoFileId) (*Resource, error) {
+	// asked first, as it tells whether the video file exists at the cost of one request
+	res, err := epgstation.EPGStation().GetVideosVideoFileIdDurationWithResponse(ctx, epgstation.PathVideoFileId(videoFileId))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode() == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: video file %d", ErrNoSuchResource, videoFileId)
+	}
+	if res.JSON200 == nil {
+		return nil, fmt.Errorf("GetVideosVideoFileIdDuration: %s", res.Status())
+	}
+	recordedItem, err := findRecorded(ctx, videoFileId)
+	if err != nil {
+		return nil, err
+	}
+	if recordedItem == nil {
+		return nil, fmt.Errorf("%w: video file %d", ErrNoSuchResource, videoFileId)
+	}
+	prepareChannels(ctx)
+	item := NewItem(recordedContainerID, recordedItem)
+	for _, r := range *item.Resources {
+		if r.videoFile.Id != videoFileId || r.transcoded || r.thumbnail {
+			continue
+		}
+		resource := &Resource{
+			Recorded:     item.recorded,
+			VideoFile:    r.videoFile,
+			Duration:     r.DurationNS,
+			Size:         r.Size,
+			ProtocolInfo: r.ProtocolInfo,
+			Recording:    r.recording,
+		}
+		// actual length of the video, rather than of the program
+		if duration := time.Duration(float64(res.JSON200.Duration) * float64(time.Second)); duration > 0 && !resource.Recording {
+			resource.Duration = duration
+		}
+		return resource, nil
+	}
+	// the format of the video file is not supported
+	return nil, fmt.Errorf("%w: video file %d", ErrNoSuchResource, videoFileId)
 }
 
-func GetResourceObject(objectID string) interface{} {
-	return resRegistory[ObjectID(objectID)]
+// findRecorded returns the recording having video file videoFileId, or nil if
+// EPGStation has no such recording. Recordings seen on the last refresh and
+// ones in progress are looked up first, as looking up every recording takes
+// a request per page.
+func findRecorded(ctx context.Context, videoFileId epgstation.VideoFileId) (*epgstation.RecordedItem, error) {
+	has := func(recordedItem *epgstation.RecordedItem) bool {
+		if recordedItem.VideoFiles == nil {
+			return false
+		}
+		for _, videoFile := range *recordedItem.VideoFiles {
+			if videoFile.Id == videoFileId {
+				return true
+			}
+		}
+		return false
+	}
+	refreshMu.Lock()
+	for _, r := range recordings {
+		if has(&r.item) {
+			// never mutated, as replaced on refresh
+			refreshMu.Unlock()
+			return &r.item, nil
+		}
+	}
+	refreshMu.Unlock()
+	recordingIt := epgstation.IterateRecording(ctx, epgstation.GetRecordingParams{})
+	for recordingIt.Next() {
+		if has(recordingIt.Value()) {
+			return recordingIt.Value(), nil
+		}
+	}
+	if err := recordingIt.Err(); err != nil {
+		return nil, err
+	}
+	// not refreshed yet, or recorded since the last refresh
+	recordedIt := epgstation.IterateRecorded(ctx, epgstation.GetRecordedParams{})
+	for recordedIt.Next() {
+		if has(recordedIt.Value()) {
+			return recordedIt.Value(), nil
+		}
+	}
+	return nil, recordedIt.Err()
 }
@@ -0,0 +1,855 @@
+package contentdirectory
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"upnp-mediaserver/config"
+	"upnp-mediaserver/epgstation"
+)
+
+type didlLiteResult struct {
+	Containers []struct {
+		Id       string `xml:"id,attr"`
+		ParentID string `xml:"parentID,attr"`
+	} `xml:"container"`
+	Items []struct {
+		Id string `xml:"id,attr"`
+	} `xml:"item"`
+}
+
+func parseDIDLLite(t *testing.T, result string) didlLiteResult {
+	t.Helper()
+	var didl didlLiteResult
+	if err := xml.Unmarshal([]byte(result), &didl); err != nil {
+		t.Fatalf("invalid DIDL-Lite %s: %s", result, err)
+	}
+	return didl
+}
+
+// setupTestTree builds root with an empty container "01" and container "02" having n items
+func setupTestTree(n int) {
+	registry = NewRegistry()
+	root := NewContainer("0", nil, "Root")
+	NewContainer("01", root, "Empty")
+	container := NewContainer("02", root, "Items")
+	for i := 0; i < n; i++ {
+		container.AppendItem(&Item{
+			Id:         ObjectID(fmt.Sprintf("item%d", i)),
+			ParentID:   container.Id,
+			Title:      fmt.Sprintf("item %d", i),
+			Class:      "object.item.videoItem",
+			Restricted: "true",
+			Resources:  &[]Res{},
+		})
+	}
+}
+
+func TestMarshalDirectChildrenPaging(t *testing.T) {
+	setupTestTree(120)
+
+	tests := []struct {
+		name           string
+		objectID       string
+		startingIndex  int
+		requestedCount int
+		wantReturned   int
+		wantTotal      int
+		wantFirstID    string
+	}{
+		{"first page", "02", 0, 50, 50, 120, "item0"},
+		{"middle page", "02", 50, 50, 50, 120, "item50"},
+		{"last partial page", "02", 100, 50, 20, 120, "item100"},
+		{"zero count means all", "02", 0, 0, 120, 120, "item0"},
+		{"zero count from middle", "02", 110, 0, 10, 120, "item110"},
+		{"start at end", "02", 120, 50, 0, 120, ""},
+		{"start beyond end", "02", 500, 50, 0, 120, ""},
+		{"count beyond end", "02", 119, 1000, 1, 120, "item119"},
+		{"empty container", "01", 0, 0, 0, 0, ""},
+		{"root", "0", 0, 0, 2, 2, "01"},
+		{"item has no children", "item0", 0, 0, 0, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, numberReturned, totalMatches, err := MarshalDirectChildren(context.Background(), tt.objectID, "*", "", tt.startingIndex, tt.requestedCount)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if numberReturned != tt.wantReturned || totalMatches != tt.wantTotal {
+				t.Errorf("NumberReturned, TotalMatches = %d, %d, want %d, %d", numberReturned, totalMatches, tt.wantReturned, tt.wantTotal)
+			}
+			didl := parseDIDLLite(t, result)
+			var ids []string
+			for _, c := range didl.Containers {
+				ids = append(ids, c.Id)
+			}
+			for _, i := range didl.Items {
+				ids = append(ids, i.Id)
+			}
+			if len(ids) != numberReturned {
+				t.Errorf("%d objects in Result, but NumberReturned is %d", len(ids), numberReturned)
+			}
+			if tt.wantFirstID != "" && (len(ids) == 0 || ids[0] != tt.wantFirstID) {
+				t.Errorf("first object = %v, want %s", ids, tt.wantFirstID)
+			}
+		})
+	}
+}
+
+func TestMarshalDirectChildrenNoSuchObject(t *testing.T) {
+	setupTestTree(1)
+	_, _, _, err := MarshalDirectChildren(context.Background(), "stale", "*", "", 0, 0)
+	if !errors.Is(err, ErrNoSuchObject) {
+		t.Errorf("err = %v, want ErrNoSuchObject", err)
+	}
+}
+
+func TestMarshalMetadata(t *testing.T) {
+	setupTestTree(3)
+
+	tests := []struct {
+		name         string
+		objectID     string
+		wantParentID string
+		wantErr      error
+	}{
+		{"root", "0", "-1", nil},
+		{"container", "02", "0", nil},
+		{"unknown", "stale", "", ErrNoSuchObject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := MarshalMetadata(context.Background(), tt.objectID, "*")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			didl := parseDIDLLite(t, result)
+			if len(didl.Containers) != 1 || didl.Containers[0].Id != tt.objectID || didl.Containers[0].ParentID != tt.wantParentID {
+				t.Errorf("got %+v, want id %s with parentID %s", didl.Containers, tt.objectID, tt.wantParentID)
+			}
+		})
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	tests := []struct {
+		total, start, count int
+		wantStart, wantEnd  int
+	}{
+		{0, 0, 0, 0, 0},
+		{10, 0, 0, 0, 10},
+		{10, 3, 0, 3, 10},
+		{10, 3, 4, 3, 7},
+		{10, 8, 4, 8, 10},
+		{10, 10, 1, 10, 10},
+		{10, 11, 1, 10, 10},
+	}
+	for _, tt := range tests {
+		start, end := paginate(tt.total, tt.start, tt.count)
+		if start != tt.wantStart || end != tt.wantEnd {
+			t.Errorf("paginate(%d, %d, %d) = %d, %d, want %d, %d", tt.total, tt.start, tt.count, start, end, tt.wantStart, tt.wantEnd)
+		}
+	}
+}
+
+func testRecordedItem(id int) *epgstation.RecordedItem {
+	genre := epgstation.ProgramGenreLv1(id % 3)
+	channelId := epgstation.ChannelId(id % 2)
+	filename := fmt.Sprintf("%d.m2ts", id)
+	return &epgstation.RecordedItem{
+		Id:         epgstation.RecordedId(id),
+		Name:       fmt.Sprintf("recorded %d", id),
+		StartAt:    epgstation.UnixtimeMS(id * 3600 * 1000),
+		Genre1:     &genre,
+		ChannelId:  &channelId,
+		Thumbnails: &[]epgstation.ThumbnailId{},
+		VideoFiles: &[]epgstation.VideoFile{{Id: epgstation.VideoFileId(id), Filename: &filename, Size: 1000}},
+	}
+}
+
+// TestConcurrentBrowse browses and searches while recordings are added and
+// removed, and containers listing them are invalidated. Run with -race.
+func TestConcurrentBrowse(t *testing.T) {
+	setCacheTTL(time.Hour)
+	channels.Lock()
+	channels.byId = make(map[epgstation.ChannelId]epgstation.ChannelItem)
+	for i := 0; i < 2; i++ {
+		channelId := epgstation.ChannelId(i)
+		channels.byId[channelId] = epgstation.ChannelItem{Id: channelId, HalfWidthName: fmt.Sprint("channel ", i)}
+	}
+	channels.Unlock()
+
+	// recordings on fake EPGStation
+	var mu sync.Mutex
+	recorded := make(map[int]*epgstation.RecordedItem)
+	load := func(match func(*epgstation.RecordedItem) bool) loader {
+		return func(ctx context.Context, container *Container) ([]interface{}, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			var items []interface{}
+			for _, recordedItem := range recorded {
+				if match(recordedItem) {
+					items = append(items, NewItem(container.Id, recordedItem))
+				}
+			}
+			return items, nil
+		}
+	}
+	loadChannels := func(ctx context.Context, container *Container) ([]interface{}, error) {
+		var children []interface{}
+		for i := 0; i < 2; i++ {
+			channelId := epgstation.ChannelId(i)
+			child := newLazyContainer(channelContainerID(channelId), container.Id, fmt.Sprint("channel ", i), load(func(recordedItem *epgstation.RecordedItem) bool {
+				return *recordedItem.ChannelId == channelId
+			}), -1)
+			child.subset = true
+			children = append(children, child)
+		}
+		return children, nil
+	}
+	setupFakeEPGStation(t, func() []epgstation.RecordedItem {
+		mu.Lock()
+		defer mu.Unlock()
+		var records []epgstation.RecordedItem
+		for _, recordedItem := range recorded {
+			records = append(records, *recordedItem)
+		}
+		return records
+	})
+	registry = NewRegistry()
+	registry.Lock()
+	root := NewContainer("0", nil, "Root")
+	root.AppendContainer(newLazyContainer(recordedContainerID, root.Id, "録画済み", load(func(*epgstation.RecordedItem) bool { return true }), -1))
+	root.AppendContainer(newLazyContainer(channelsContainerID, root.Id, "チャンネル別", loadChannels, -1))
+	registry.Unlock()
+
+	const n = 50
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for round := 0; round < 20; round++ {
+			mu.Lock()
+			for i := 0; i < n; i++ {
+				// ids start from 1 as EPGStation does
+				id := round*n/2 + i + 1
+				delete(recorded, id-n/2)
+				recorded[id] = testRecordedItem(id)
+			}
+			mu.Unlock()
+			invalidate(recordedContainerID, channelsContainerID, channelContainerID(0), channelContainerID(1))
+		}
+	}()
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, objectID := range []ObjectID{"0", recordedContainerID, channelsContainerID, channelContainerID(0), channelContainerID(1), childID(channelContainerID(1), 1)} {
+					if _, _, _, err := MarshalDirectChildren(context.Background(), string(objectID), "*", "-dc:date", 0, 10); err != nil && !errors.Is(err, ErrNoSuchObject) {
+						t.Error(err)
+						return
+					}
+					if _, err := MarshalMetadata(context.Background(), string(objectID), "*"); err != nil && !errors.Is(err, ErrNoSuchObject) {
+						t.Error(err)
+						return
+					}
+				}
+				if _, _, _, err := Search(context.Background(), "0", `upnp:channelName contains "channel"`, "*", "", 0, 0); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := LookupResource(context.Background(), 1); err != nil && !errors.Is(err, ErrNoSuchResource) {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, _, total, err := MarshalDirectChildren(context.Background(), string(recordedContainerID), "*", "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != len(recorded) {
+		t.Errorf("%s has %d children, want %d", recordedContainerID, total, len(recorded))
+	}
+	loadLocks.Lock()
+	if n := len(loadLocks.m); n != 0 {
+		t.Errorf("%d load locks are left", n)
+	}
+	loadLocks.Unlock()
+}
+
+// TestItemIDs checks a recording in several containers has distinct IDs
+// referring to the one in 録画済み, and is found by ID before browsing
+func TestItemIDs(t *testing.T) {
+	setCacheTTL(time.Hour)
+	recordedItem := testRecordedItem(1)
+	load := func(ctx context.Context, container *Container) ([]interface{}, error) {
+		return []interface{}{NewItem(container.Id, recordedItem)}, nil
+	}
+	registry = NewRegistry()
+	registry.Lock()
+	root := NewContainer("0", nil, "Root")
+	root.AppendContainer(newLazyContainer(recordedContainerID, root.Id, "録画済み", load, -1))
+	root.AppendContainer(newLazyContainer(genresContainerID, root.Id, "ジャンル別", func(ctx context.Context, container *Container) ([]interface{}, error) {
+		return []interface{}{newLazyContainer(genreContainerID(1), container.Id, "スポーツ", load, 1)}, nil
+	}, -1))
+	registry.Unlock()
+
+	tests := []struct {
+		id, parentID, refID string
+	}{
+		{"recorded/1", "recorded", ""},
+		{"genres/1/1", "genres/1", "recorded/1"},
+	}
+	for _, tt := range tests {
+		result, err := MarshalMetadata(context.Background(), tt.id, "*")
+		if err != nil {
+			t.Fatalf("%s: %s", tt.id, err)
+		}
+		var didl struct {
+			Items []struct {
+				Id       string `xml:"id,attr"`
+				ParentID string `xml:"parentID,attr"`
+				RefID    string `xml:"refID,attr"`
+			} `xml:"item"`
+		}
+		if err := xml.Unmarshal([]byte(result), &didl); err != nil {
+			t.Fatal(err)
+		}
+		if len(didl.Items) != 1 {
+			t.Fatalf("%s: %d items returned", tt.id, len(didl.Items))
+		}
+		item := didl.Items[0]
+		if item.Id != tt.id || item.ParentID != tt.parentID || item.RefID != tt.refID {
+			t.Errorf("%s: got id %q parentID %q refID %q, want parentID %q refID %q", tt.id, item.Id, item.ParentID, item.RefID, tt.parentID, tt.refID)
+		}
+	}
+}
+
+// setupFakeEPGStation points the client to a fake EPGStation serving
+// recordings returned by records, and returns the number of requests served
+func setupFakeEPGStation(t *testing.T, records func() []epgstation.RecordedItem) func() int64 {
+	t.Helper()
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/recorded":
+			recordedItems := records()
+			json.NewEncoder(w).Encode(epgstation.Records{Records: recordedItems, Total: len(recordedItems)})
+		case "/api/recording":
+			fmt.Fprint(w, `{"records": [], "total": 0}`)
+		case "/api/tags":
+			fmt.Fprint(w, `{"tags": [], "total": 0}`)
+		case "/api/recorded/options":
+			fmt.Fprint(w, `{"channels": [], "genres": []}`)
+		case "/api/channels":
+			fmt.Fprint(w, `[]`)
+		default:
+			var videoFileId epgstation.VideoFileId
+			if _, err := fmt.Sscanf(r.URL.Path, "/api/videos/%d/duration", &videoFileId); err == nil {
+				for _, recordedItem := range records() {
+					if recordedItem.VideoFiles == nil {
+						continue
+					}
+					for _, videoFile := range *recordedItem.VideoFiles {
+						if videoFile.Id == videoFileId {
+							fmt.Fprint(w, `{"duration": 1800.5}`)
+							return
+						}
+					}
+				}
+			}
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	epgstation.Setup(server.URL)
+	resourceLookups.Lock()
+	resourceLookups.missing = make(map[epgstation.VideoFileId]time.Time)
+	resourceLookups.Unlock()
+	return func() int64 { return atomic.LoadInt64(&requests) }
+}
+
+// TestRefreshRemoved checks recordings without files, which EPGStation
+// reports without videoFiles, can be listed and removed
+func TestRefreshRemoved(t *testing.T) {
+	setCacheTTL(time.Hour)
+	noFiles := testRecordedItem(2)
+	noFiles.VideoFiles, noFiles.Thumbnails = nil, nil
+	records := []epgstation.RecordedItem{*testRecordedItem(1), *noFiles}
+	setupFakeEPGStation(t, func() []epgstation.RecordedItem { return records })
+
+	registry = NewRegistry()
+	registry.Lock()
+	root := NewContainer("0", nil, "Root")
+	root.AppendContainer(newLazyContainer(recordedContainerID, root.Id, "録画済み", func(ctx context.Context, container *Container) ([]interface{}, error) {
+		var items []interface{}
+		for i := range records {
+			items = append(items, NewItem(container.Id, &records[i]))
+		}
+		return items, nil
+	}, -1))
+	registry.Unlock()
+	refreshMu.Lock()
+	recordings = nil
+	refreshMu.Unlock()
+
+	if n, err := refresh(context.Background()); err != nil || n != 2 {
+		t.Fatalf("first refresh: %d recordings, %v", n, err)
+	}
+	if _, numberReturned, _, err := MarshalDirectChildren(context.Background(), string(recordedContainerID), "*", "", 0, 0); err != nil || numberReturned != 2 {
+		t.Fatalf("browse: %d items, %v", numberReturned, err)
+	}
+	records = records[:1]
+	if n, err := refresh(context.Background()); err != nil || n != 1 {
+		t.Fatalf("refresh after removal: %d recordings, %v", n, err)
+	}
+	if _, numberReturned, _, err := MarshalDirectChildren(context.Background(), string(recordedContainerID), "*", "", 0, 0); err != nil || numberReturned != 1 {
+		t.Errorf("browse after removal: %d items, %v", numberReturned, err)
+	}
+}
+
+// TestLookupResourceNotListed checks resources not listed since restart are
+// fetched from EPGStation
+func TestLookupResourceNotListed(t *testing.T) {
+	records := []epgstation.RecordedItem{*testRecordedItem(1), *testRecordedItem(2)}
+	requests := setupFakeEPGStation(t, func() []epgstation.RecordedItem { return records })
+	registry = NewRegistry()
+	refreshMu.Lock()
+	recordings = nil
+	refreshMu.Unlock()
+	channels.Lock()
+	channels.items, channels.byId = []epgstation.ChannelItem{}, make(map[epgstation.ChannelId]epgstation.ChannelItem)
+	channels.Unlock()
+
+	// concurrent lookups of the same video file ask EPGStation once
+	var wg sync.WaitGroup
+	found := make([]*Resource, 4)
+	for i := range found {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			found[i], _ = LookupResource(context.Background(), 2)
+		}(i)
+	}
+	wg.Wait()
+	resource := found[0]
+	if resource == nil {
+		t.Fatal("video file 2 is not found")
+	}
+	for _, r := range found[1:] {
+		if r != resource {
+			t.Error("concurrent lookups returned different resources")
+		}
+	}
+	// duration, recording and recorded
+	if n := requests(); n != 3 {
+		t.Errorf("%d requests to EPGStation, want 3", n)
+	}
+	if resource.Recorded.Id != 2 || resource.Size != 1000 || resource.Duration != 1800500*time.Millisecond {
+		t.Errorf("resource = recorded %d, size %d, duration %s", resource.Recorded.Id, resource.Size, resource.Duration)
+	}
+	if again, err := LookupResource(context.Background(), 2); err != nil || again != resource {
+		t.Errorf("resource is not registered: %v", err)
+	}
+	before := requests()
+	for i := 0; i < 2; i++ {
+		if _, err := LookupResource(context.Background(), 3); !errors.Is(err, ErrNoSuchResource) {
+			t.Errorf("unknown video file: err = %v, want ErrNoSuchResource", err)
+		}
+	}
+	// the cheap check only, remembered after
+	if n := requests() - before; n != 1 {
+		t.Errorf("%d requests to EPGStation for unknown video file, want 1", n)
+	}
+}
+
+func TestParseSearchCriteria(t *testing.T) {
+	refID := ObjectID("recorded/1")
+	description := "say \"hello\""
+	item := &Item{
+		Id:          "genres/1/1",
+		ParentID:    "genres/1",
+		Title:       "Foo Bar",
+		Class:       "object.item.videoItem",
+		RefID:       &refID,
+		Date:        "2023-11-15T07:00:00",
+		Description: &description,
+		Genres:      []string{"スポーツ", "ニュース"},
+	}
+	container := &Container{Id: "genres/1", ParentID: "genres", Title: "スポーツ", Class: "object.container"}
+	// as live broadcasts, which are not recordings
+	channelName := "NHK BS1"
+	item.ChannelName = &channelName
+
+	tests := []struct {
+		criteria    string
+		item        bool
+		container   bool
+		wantInvalid bool
+	}{
+		{"*", true, true, false},
+		{`dc:title = "foo bar"`, true, false, false},
+		{`dc:title contains "BAR"`, true, false, false},
+		{`dc:title doesNotContain "bar"`, false, true, false},
+		{`dc:title != "foo bar"`, false, true, false},
+		{`upnp:class derivedfrom "object.item"`, true, false, false},
+		{`upnp:class derivedfrom "object.item.video"`, false, false, false},
+		{`upnp:class = "object.container"`, false, true, false},
+		{`upnp:genre = "ニュース"`, true, false, false},
+		{`dc:date = "2023-11-15"`, true, false, false},
+		{`dc:date >= "2023-11-16"`, false, false, false},
+		{`dc:description = "say \"hello\""`, true, false, false},
+		{`@refID exists true`, true, false, false},
+		{`@refID exists false`, false, true, false},
+		{`@id = "genres/1"`, false, true, false},
+		{`@parentID = "genres/1"`, true, false, false},
+		{`upnp:channelName contains "bs1"`, true, false, false},
+		// unknown properties have no values
+		{`upnp:artist exists true`, false, false, false},
+		{`upnp:artist = "foo"`, false, false, false},
+		{`upnp:artist != "foo"`, true, true, false},
+		// and binds tighter than or
+		{`dc:title = "スポーツ" or dc:title = "foo bar" and upnp:genre = "映画"`, false, true, false},
+		{`(dc:title = "スポーツ" or dc:title = "foo bar") and upnp:genre = "映画"`, false, false, false},
+		{`dc:title = "スポーツ" OR upnp:class derivedfrom "object.item" AND @refID exists true`, true, true, false},
+		// and, or and operators in quoted values are values
+		{`dc:title contains "foo" and dc:title != "and"`, true, false, false},
+		{"", false, false, true},
+		{`dc:title = foo`, false, false, true},
+		{`dc:title = "foo`, false, false, true},
+		{`dc:title "foo"`, false, false, true},
+		{`dc:title ! "foo"`, false, false, true},
+		{`dc:title like "foo"`, false, false, true},
+		{`dc:title exists yes`, false, false, true},
+		{`"dc:title" = "foo"`, false, false, true},
+		{`(dc:title = "foo"`, false, false, true},
+		{`dc:title = "foo")`, false, false, true},
+		{`dc:title = "foo" and`, false, false, true},
+		{`()`, false, false, true},
+	}
+	for _, tt := range tests {
+		exp, err := parseSearchCriteria(tt.criteria)
+		if tt.wantInvalid {
+			if !errors.Is(err, ErrInvalidSearchCriteria) {
+				t.Errorf("%s: err = %v, want ErrInvalidSearchCriteria", tt.criteria, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.criteria, err)
+			continue
+		}
+		if got := exp.match(item); got != tt.item {
+			t.Errorf("%s: item matched %v, want %v", tt.criteria, got, tt.item)
+		}
+		if got := exp.match(container); got != tt.container {
+			t.Errorf("%s: container matched %v, want %v", tt.criteria, got, tt.container)
+		}
+	}
+}
+
+func compileAll(patterns []string) []*regexp.Regexp {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		res[i] = regexp.MustCompile(pattern)
+	}
+	return res
+}
+
+func TestSeriesTitle(t *testing.T) {
+	setSeriesRules(compileAll(config.DefaultSeriesStripPatterns), compileAll(config.DefaultSeriesEpisodePatterns))
+	tests := []struct {
+		name    string
+		series  string
+		episode int
+	}{
+		{"ドラマ名 #3「サブタイトル」", "ドラマ名", 3},
+		{"ドラマ名　＃１２", "ドラマ名", 12},
+		{"【新】アニメ 第1話「始まり」[字]", "アニメ", 1},
+		{"アニメ 第12話", "アニメ", 12},
+		{"[再]ＮＨＫスペシャル", "NHKスペシャル", 0},
+		{"#1", "#1", 1},
+	}
+	for _, tt := range tests {
+		recordedItem := &epgstation.RecordedItem{Name: tt.name}
+		if got := seriesTitle(recordedItem); got != tt.series {
+			t.Errorf("seriesTitle(%q) = %q, want %q", tt.name, got, tt.series)
+		}
+		if got, _ := episodeNumber(recordedItem); got != tt.episode {
+			t.Errorf("episodeNumber(%q) = %d, want %d", tt.name, got, tt.episode)
+		}
+	}
+}
+
+func TestSortEpisodes(t *testing.T) {
+	setSeriesRules(compileAll(config.DefaultSeriesStripPatterns), compileAll(config.DefaultSeriesEpisodePatterns))
+	episode := func(name string, startAt int) *epgstation.RecordedItem {
+		return &epgstation.RecordedItem{Name: name, StartAt: epgstation.UnixtimeMS(startAt)}
+	}
+	records := []*epgstation.RecordedItem{
+		episode("ドラマ名 #1", 3),
+		episode("ドラマ名 特別編", 2),
+		episode("ドラマ名 #2", 1),
+		episode("ドラマ名 総集編", 0),
+		episode("ドラマ名 #1", 4),
+	}
+	sortEpisodes(records)
+	var got []string
+	for _, recordedItem := range records {
+		got = append(got, fmt.Sprint(recordedItem.Name, "@", recordedItem.StartAt))
+	}
+	want := []string{"ドラマ名 #1@3", "ドラマ名 #1@4", "ドラマ名 #2@1", "ドラマ名 総集編@0", "ドラマ名 特別編@2"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("sortEpisodes = %v, want %v", got, want)
+	}
+}
+
+func TestSortObjects(t *testing.T) {
+	recorded := func(id ObjectID, title string, startAt int, size int) *Item {
+		return &Item{
+			Id:        id,
+			Title:     title,
+			Class:     "object.item.videoItem",
+			Resources: &[]Res{{Size: size}},
+			recorded:  &epgstation.RecordedItem{StartAt: epgstation.UnixtimeMS(startAt)},
+		}
+	}
+	channelNames := []string{"GR1", "BS1"}
+	objects := []interface{}{
+		recorded("r1", "c", 2000, 100),
+		&Container{Id: "c", Title: "B", Class: "object.container"},
+		recorded("r2", "A", 3000, 50),
+		// live broadcast, having dc:date but no recording
+		&Item{Id: "live", Title: "a", Class: "object.item.videoItem.videoBroadcast", Date: "1970-01-01T09:00:01+09:00", ChannelName: &channelNames[1]},
+	}
+	objects[0].(*Item).ChannelName = &channelNames[0]
+
+	tests := []struct {
+		criteria string
+		want     []ObjectID
+	}{
+		{"", []ObjectID{"r1", "c", "r2", "live"}},
+		{"+dc:date", []ObjectID{"c", "live", "r1", "r2"}},
+		{"-dc:date", []ObjectID{"r2", "r1", "live", "c"}},
+		{"dc:title", []ObjectID{"r2", "live", "c", "r1"}},
+		{"-res@size", []ObjectID{"r1", "r2", "c", "live"}},
+		{"+upnp:class, -dc:date", []ObjectID{"c", "r2", "r1", "live"}},
+		{"upnp:channelName", []ObjectID{"c", "r2", "live", "r1"}},
+	}
+	for _, tt := range tests {
+		sorted, err := sortObjects(objects, tt.criteria)
+		if err != nil {
+			t.Errorf("%q: %s", tt.criteria, err)
+			continue
+		}
+		var got []ObjectID
+		for _, object := range sorted {
+			switch object := object.(type) {
+			case *Container:
+				got = append(got, object.Id)
+			case *Item:
+				got = append(got, object.Id)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%q: sorted %v, want %v", tt.criteria, got, tt.want)
+		}
+	}
+	if _, err := sortObjects(objects, "+dc:creator"); !errors.Is(err, ErrInvalidSortCriteria) {
+		t.Errorf("unsupported property: err = %v, want ErrInvalidSortCriteria", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	description := "description"
+	item := &Item{
+		Id:          "recorded/1",
+		ParentID:    "recorded",
+		Title:       "title",
+		Class:       "object.item.videoItem",
+		Restricted:  "true",
+		Date:        "2023-11-15T07:00:00+09:00",
+		Description: &description,
+		Resources: &[]Res{{
+			ProtocolInfo: "http-get:*:video/mpeg:*",
+			Size:         1000,
+			Duration:     "0:30:00.000",
+			URL:          "http://127.0.0.1/videos/recorded?videoFileId=1",
+		}},
+		AlbumArtURI: &AlbumArtURI{ProfileID: "JPEG_TN", URL: "http://127.0.0.1/thumbnails/1"},
+	}
+	load := func(ctx context.Context, container *Container) ([]interface{}, error) { return nil, nil }
+	hinted := newLazyContainer("hinted", "0", "hinted", load, 3)
+	unknown := newLazyContainer("unknown", "0", "unknown", load, -1)
+	resolved := newLazyContainer("resolved", "0", "resolved", load, 3)
+	resolved.Children = []interface{}{item}
+
+	required := []string{`id="recorded/1"`, `parentID="recorded"`, `restricted="true"`, "<title", "<class"}
+	tests := []struct {
+		filter  string
+		want    []string
+		notWant []string
+	}{
+		{"*", []string{"<date", "<description", `size="1000"`, `duration="0:30:00.000"`, "videoFileId=1", "<albumArtURI", `profileID="JPEG_TN"`}, nil},
+		{"", nil, []string{"<date", "<description", "<res", "<albumArtURI"}},
+		{"dc:date, dc:description", []string{"<date", "<description"}, []string{"size=", "<albumArtURI"}},
+		// attributes imply their element, which has protocolInfo always
+		{"res@size", []string{`size="1000"`, "videoFileId=1", `protocolInfo="http-get:*:video/mpeg:*"`}, []string{"duration=", "<date"}},
+		{"res", []string{"videoFileId=1", `protocolInfo="http-get:*:video/mpeg:*"`}, []string{"size=", "duration="}},
+		{"upnp:albumArtURI", []string{"thumbnails/1"}, []string{"profileID="}},
+		{"upnp:albumArtURI@dlna:profileID", []string{`profileID="JPEG_TN"`}, nil},
+		{"dc:creator,upnp:actor", nil, []string{"<date", "size="}},
+	}
+	for _, tt := range tests {
+		result, err := marshalDIDLLite([]interface{}{item}, ParseFilter(tt.filter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range append(required, tt.want...) {
+			if !strings.Contains(result, s) {
+				t.Errorf("filter %q: %s is missing in %s", tt.filter, s, result)
+			}
+		}
+		for _, s := range tt.notWant {
+			if strings.Contains(result, s) {
+				t.Errorf("filter %q: %s is in %s", tt.filter, s, result)
+			}
+		}
+	}
+
+	childCounts := []struct {
+		filter    string
+		container *Container
+		want      string
+	}{
+		{"@childCount", hinted, `childCount="3"`},
+		{"*", hinted, `childCount="3"`},
+		{"*", resolved, `childCount="1"`},
+		{"*", unknown, ""},
+		{"", hinted, ""},
+		{"dc:title", resolved, ""},
+	}
+	for _, tt := range childCounts {
+		result, err := marshalDIDLLite([]interface{}{tt.container}, ParseFilter(tt.filter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.want == "" {
+			if strings.Contains(result, "childCount") {
+				t.Errorf("filter %q of %s: childCount is in %s", tt.filter, tt.container.Id, result)
+			}
+		} else if !strings.Contains(result, tt.want) {
+			t.Errorf("filter %q of %s: %s is missing in %s", tt.filter, tt.container.Id, tt.want, result)
+		}
+	}
+	if hinted.Children != nil || hinted.ChildCount != nil {
+		t.Error("filter modified the container")
+	}
+}
+
+// TestResolveDropped checks children loaded for a container dropped while
+// loading, as by Rebuild, are not registered
+func TestResolveDropped(t *testing.T) {
+	setCacheTTL(time.Hour)
+	newItem := func(id ObjectID) *Item {
+		return &Item{Id: id, ParentID: "dropped", Title: string(id), Class: "object.item.videoItem", Resources: &[]Res{}}
+	}
+	registry = NewRegistry()
+	registry.Lock()
+	root := NewContainer("0", nil, "Root")
+	var stale *Container
+	stale = newLazyContainer("dropped", root.Id, "dropped", func(ctx context.Context, container *Container) ([]interface{}, error) {
+		// rebuilt while loading
+		registry.Lock()
+		unregister(stale)
+		root.Children = nil
+		root.AppendContainer(newLazyContainer("dropped", root.Id, "dropped", func(ctx context.Context, container *Container) ([]interface{}, error) {
+			return []interface{}{newItem("dropped/new")}, nil
+		}, -1))
+		registry.Unlock()
+		return []interface{}{newItem("dropped/stale")}, nil
+	}, -1)
+	root.AppendContainer(stale)
+	registry.Unlock()
+
+	result, numberReturned, _, err := MarshalDirectChildren(context.Background(), "dropped", "*", "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numberReturned != 1 || !strings.Contains(result, "dropped/new") {
+		t.Errorf("children of the current container are not returned: %s", result)
+	}
+	if _, err := MarshalMetadata(context.Background(), "dropped/stale", "*"); !errors.Is(err, ErrNoSuchObject) {
+		t.Errorf("stale child is registered: err = %v", err)
+	}
+	if stale.Children != nil {
+		t.Error("children are published to the dropped container")
+	}
+}
+
+func TestFingerprintSubGenre(t *testing.T) {
+	recordedItem := testRecordedItem(1)
+	before := fingerprint(recordedItem)
+	subGenre := epgstation.ProgramGenreLv2(2)
+	recordedItem.SubGenre1 = &subGenre
+	if fingerprint(recordedItem) == before {
+		t.Error("fingerprint does not change with subgenre")
+	}
+}
+
+// TestSearchRoot checks searching from root does not resolve ルール別, which
+// asks EPGStation for each rule. The fake EPGStation has no rules API.
+func TestSearchRoot(t *testing.T) {
+	setCacheTTL(time.Hour)
+	records := []epgstation.RecordedItem{*testRecordedItem(1), *testRecordedItem(2)}
+	setupFakeEPGStation(t, func() []epgstation.RecordedItem { return records })
+	refreshMu.Lock()
+	recordings = nil
+	refreshMu.Unlock()
+	resetChannels()
+	registry.Lock()
+	newTree()
+	registry.Unlock()
+
+	_, _, totalMatches, err := Search(context.Background(), "0", `upnp:class derivedfrom "object.item.videoItem"`, "*", "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if totalMatches != len(records) {
+		t.Errorf("%d recordings found, want %d", totalMatches, len(records))
+	}
+	registry.RLock()
+	rules, _ := registry.container(rulesContainerID)
+	resolved := rules.Children != nil
+	registry.RUnlock()
+	if resolved {
+		t.Errorf("%s is resolved", rulesContainerID)
+	}
+}
@@ -0,0 +1,160 @@
+package contentdirectory
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"upnp-mediaserver/epgstation"
+)
+
+var weekdayNames = [...]string{"日", "月", "火", "水", "木", "金", "土"}
+
+// order of 曜日別, as TV program guides list
+var weekdayOrder = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}
+
+func yearContainerID(t time.Time) ObjectID {
+	return childID(datesContainerID, t.Year())
+}
+
+func monthContainerID(t time.Time) ObjectID {
+	return childID(yearContainerID(t), int(t.Month()))
+}
+
+func dayContainerID(t time.Time) ObjectID {
+	return childID(monthContainerID(t), t.Day())
+}
+
+func weekdayContainerID(weekday time.Weekday) ObjectID {
+	return childID(weekdaysContainerID, int(weekday))
+}
+
+// recordedWhen returns recordings whose start time matches, newest first
+func recordedWhen(ctx context.Context, match func(t time.Time) bool) ([]*epgstation.RecordedItem, error) {
+	records, err := recorded(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var matched []*epgstation.RecordedItem
+	for _, recordedItem := range records {
+		if match(startTime(recordedItem)) {
+			matched = append(matched, recordedItem)
+		}
+	}
+	return matched, nil
+}
+
+// dateContainers groups recordings into containers under container by key
+// of start time, newest first. Recordings are sorted newest first.
+func dateContainers(container *Container, records []*epgstation.RecordedItem, key func(t time.Time) int, title func(key int) string, load func(t time.Time) loader) []interface{} {
+	var children []interface{}
+	var child *Container
+	for _, recordedItem := range records {
+		t := startTime(recordedItem)
+		if child == nil || child.Id != childID(container.Id, key(t)) {
+			child = newLazyContainer(childID(container.Id, key(t)), container.Id, title(key(t)), load(t), 0)
+			child.subset = true
+			children = append(children, child)
+		}
+		child.countHint++
+	}
+	for _, child := range children {
+		child := child.(*Container)
+		child.Title = fmt.Sprintf("%s (%d)", child.Title, child.countHint)
+	}
+	return children
+}
+
+// itemsWhen returns a loader of items recorded at time matching
+func itemsWhen(match func(t time.Time) bool) loader {
+	return func(ctx context.Context, container *Container) ([]interface{}, error) {
+		records, err := recordedWhen(ctx, match)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]interface{}, len(records))
+		for i, recordedItem := range records {
+			items[i] = NewItem(container.Id, recordedItem)
+		}
+		return items, nil
+	}
+}
+
+func loadYears(ctx context.Context, container *Container) ([]interface{}, error) {
+	records, err := recordedWhen(ctx, func(t time.Time) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	return dateContainers(container, records,
+		func(t time.Time) int { return t.Year() },
+		func(year int) string { return fmt.Sprintf("%d年", year) },
+		loadMonths,
+	), nil
+}
+
+// loadMonths returns a loader of months of the year of t
+func loadMonths(t time.Time) loader {
+	year := t.Year()
+	return func(ctx context.Context, container *Container) ([]interface{}, error) {
+		records, err := recordedWhen(ctx, func(t time.Time) bool { return t.Year() == year })
+		if err != nil {
+			return nil, err
+		}
+		return dateContainers(container, records,
+			func(t time.Time) int { return int(t.Month()) },
+			func(month int) string { return fmt.Sprintf("%d月", month) },
+			loadDays,
+		), nil
+	}
+}
+
+// loadDays returns a loader of days of the month of t
+func loadDays(t time.Time) loader {
+	year, month := t.Year(), t.Month()
+	return func(ctx context.Context, container *Container) ([]interface{}, error) {
+		records, err := recordedWhen(ctx, func(t time.Time) bool { return t.Year() == year && t.Month() == month })
+		if err != nil {
+			return nil, err
+		}
+		return dateContainers(container, records,
+			func(t time.Time) int { return t.Day() },
+			func(day int) string {
+				weekday := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Weekday()
+				return fmt.Sprintf("%d日(%s)", day, weekdayNames[weekday])
+			},
+			loadDay,
+		), nil
+	}
+}
+
+// loadDay returns a loader of items recorded on the day of t
+func loadDay(t time.Time) loader {
+	year, month, day := t.Date()
+	return itemsWhen(func(t time.Time) bool {
+		y, m, d := t.Date()
+		return y == year && m == month && d == day
+	})
+}
+
+func loadWeekdays(ctx context.Context, container *Container) ([]interface{}, error) {
+	records, err := recorded(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[time.Weekday]int)
+	for _, recordedItem := range records {
+		counts[startTime(recordedItem).Weekday()]++
+	}
+	var children []interface{}
+	for _, weekday := range weekdayOrder {
+		if counts[weekday] == 0 {
+			continue
+		}
+		weekday := weekday
+		child := newLazyContainer(weekdayContainerID(weekday), container.Id, fmt.Sprintf("%s曜日 (%d)", weekdayNames[weekday], counts[weekday]), itemsWhen(func(t time.Time) bool {
+			return t.Weekday() == weekday
+		}), counts[weekday])
+		child.subset = true
+		children = append(children, child)
+	}
+	return children, nil
+}
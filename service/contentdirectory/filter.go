@@ -0,0 +1,176 @@
+package contentdirectory
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+)
+
+// namespace prefixes of DIDL-Lite properties used in Filter
+var namespacePrefixes = map[string]string{
+	"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/": "",
+	"http://purl.org/dc/elements/1.1/":             "dc:",
+	"urn:schemas-upnp-org:metadata-1-0/upnp/":      "upnp:",
+	"urn:schemas-dlna-org:metadata-1-0/":           "dlna:",
+}
+
+// properties always returned regardless of Filter
+var requiredProperties = map[string]bool{
+	"@id":              true,
+	"@parentID":        true,
+	"@restricted":      true,
+	"dc:title":         true,
+	"upnp:class":       true,
+	"res@protocolInfo": true,
+}
+
+// A Filter is a parsed Filter argument of Browse and Search described in ContentDirectory:1 section 2.5.6
+type Filter struct {
+	all        bool
+	properties map[string]bool
+}
+
+func ParseFilter(filter string) Filter {
+	f := Filter{properties: make(map[string]bool)}
+	for _, property := range strings.Split(filter, ",") {
+		property = strings.TrimSpace(property)
+		switch property {
+		case "":
+		case "*":
+			f.all = true
+		default:
+			f.properties[property] = true
+			// requesting attribute of an element like res@size implies the element
+			if i := strings.Index(property, "@"); i > 0 {
+				f.properties[property[:i]] = true
+			}
+		}
+	}
+	return f
+}
+
+func (f Filter) includes(property string) bool {
+	return f.all || requiredProperties[property] || f.properties[property]
+}
+
+// propertyName returns property name of struct field used in Filter like
+// "dc:date", "@childCount" or "res@size"
+func propertyName(field reflect.StructField, parent string) (string, bool) {
+	tag := field.Tag.Get("xml")
+	if tag == "-" || field.PkgPath != "" || field.Name == "XMLName" {
+		return "", false
+	}
+	if tag == "" {
+		// element name is given by XMLName of the element type, like Res
+		t := field.Type
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return "", false
+		}
+		xmlName, ok := t.FieldByName("XMLName")
+		if !ok {
+			return "", false
+		}
+		tag = xmlName.Tag.Get("xml")
+	}
+	opts := strings.Split(tag, ",")
+	name := opts[0]
+	if name == "" {
+		// ,chardata and so on
+		return "", false
+	}
+	prefix := ""
+	if i := strings.LastIndex(name, " "); i >= 0 {
+		prefix = namespacePrefixes[name[:i]]
+		name = name[i+1:]
+	}
+	for _, opt := range opts[1:] {
+		if opt == "attr" {
+			return parent + "@" + prefix + name, true
+		}
+	}
+	return prefix + name, true
+}
+
+// filterValue returns copy of struct v with properties not included in f cleared
+func (f Filter) filterValue(v reflect.Value, parent string) reflect.Value {
+	out := reflect.New(v.Type()).Elem()
+	out.Set(v)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := propertyName(field, parent)
+		if !ok {
+			continue
+		}
+		fv := out.Field(i)
+		if !f.includes(name) {
+			fv.Set(reflect.Zero(field.Type))
+			continue
+		}
+		// filter attributes of nested elements like res
+		switch {
+		case fv.Kind() == reflect.Ptr && !fv.IsNil() && fv.Elem().Kind() == reflect.Slice:
+			filtered := f.filterSlice(fv.Elem(), name)
+			ptr := reflect.New(filtered.Type())
+			ptr.Elem().Set(filtered)
+			fv.Set(ptr)
+		case fv.Kind() == reflect.Slice:
+			fv.Set(f.filterSlice(fv, name))
+		case fv.Kind() == reflect.Ptr && !fv.IsNil() && fv.Elem().Kind() == reflect.Struct:
+			fv.Set(f.filterValue(fv.Elem(), name).Addr())
+		}
+	}
+	return out
+}
+
+func (f Filter) filterSlice(v reflect.Value, parent string) reflect.Value {
+	if v.Type().Elem().Kind() != reflect.Struct {
+		return v
+	}
+	out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+	for i := 0; i < v.Len(); i++ {
+		out.Index(i).Set(f.filterValue(v.Index(i), parent))
+	}
+	return out
+}
+
+// apply returns copy of object to be serialized, having only properties included in f
+func (f Filter) apply(object interface{}) interface{} {
+	switch object := object.(type) {
+	case *Container:
+		container := *object
+		switch {
+		case object.Children != nil:
+			childCount := len(object.Children)
+			container.ChildCount = &childCount
+		case object.countHint >= 0:
+			// not resolved yet
+			childCount := object.countHint
+			container.ChildCount = &childCount
+		default:
+			container.ChildCount = nil
+		}
+		return f.filterValue(reflect.ValueOf(container), "").Addr().Interface()
+	case *Item:
+		return f.filterValue(reflect.ValueOf(*object), "").Addr().Interface()
+	}
+	return object
+}
+
+func marshalDIDLLite(objects []interface{}, filter Filter) (string, error) {
+	wrapper := DIDLLite{
+		DLNANamespace: "urn:schemas-dlna-org:metadata-1-0/",
+		Objects:       make([]interface{}, len(objects)),
+	}
+	for i, object := range objects {
+		wrapper.Objects[i] = filter.apply(object)
+	}
+	data, err := xml.Marshal(wrapper)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
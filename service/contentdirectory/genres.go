@@ -0,0 +1,203 @@
+package contentdirectory
+
+import (
+	"context"
+	"sort"
+	"upnp-mediaserver/epgstation"
+)
+
+// subgenre names of ARIB STD-B10 content_nibble_level_2 for each genre
+var subGenreIdNameMap = map[epgstation.ProgramGenreLv1]map[epgstation.ProgramGenreLv2]string{
+	0x0: {
+		0x0: "定時・総合", 0x1: "天気", 0x2: "特集・ドキュメント", 0x3: "政治・国会",
+		0x4: "経済・市況", 0x5: "海外・国際", 0x6: "解説", 0x7: "討論・会談",
+		0x8: "報道特番", 0x9: "ローカル・地域", 0xa: "交通", 0xf: "その他",
+	},
+	0x1: {
+		0x0: "スポーツニュース", 0x1: "野球", 0x2: "サッカー", 0x3: "ゴルフ",
+		0x4: "その他の球技", 0x5: "相撲・格闘技", 0x6: "オリンピック・国際大会", 0x7: "マラソン・陸上・水泳",
+		0x8: "モータースポーツ", 0x9: "マリン・ウィンタースポーツ", 0xa: "競馬・公営競技", 0xf: "その他",
+	},
+	0x2: {
+		0x0: "芸能・ワイドショー", 0x1: "ファッション", 0x2: "暮らし・住まい", 0x3: "健康・医療",
+		0x4: "ショッピング・通販", 0x5: "グルメ・料理", 0x6: "イベント", 0x7: "番組紹介・お知らせ",
+		0xf: "その他",
+	},
+	0x3: {
+		0x0: "国内ドラマ", 0x1: "海外ドラマ", 0x2: "時代劇", 0xf: "その他",
+	},
+	0x4: {
+		0x0: "国内ロック・ポップス", 0x1: "海外ロック・ポップス", 0x2: "クラシック・オペラ", 0x3: "ジャズ・フュージョン",
+		0x4: "歌謡曲・演歌", 0x5: "ライブ・コンサート", 0x6: "ランキング・リクエスト", 0x7: "カラオケ・のど自慢",
+		0x8: "民謡・邦楽", 0x9: "童謡・キッズ", 0xa: "民族音楽・ワールドミュージック", 0xf: "その他",
+	},
+	0x5: {
+		0x0: "クイズ", 0x1: "ゲーム", 0x2: "トークバラエティ", 0x3: "お笑い・コメディ",
+		0x4: "音楽バラエティ", 0x5: "旅バラエティ", 0x6: "料理バラエティ", 0xf: "その他",
+	},
+	0x6: {
+		0x0: "洋画", 0x1: "邦画", 0x2: "アニメ", 0xf: "その他",
+	},
+	0x7: {
+		0x0: "国内アニメ", 0x1: "海外アニメ", 0x2: "特撮", 0xf: "その他",
+	},
+	0x8: {
+		0x0: "社会・時事", 0x1: "歴史・紀行", 0x2: "自然・動物・環境", 0x3: "宇宙・科学・医学",
+		0x4: "カルチャー・伝統文化", 0x5: "文学・文芸", 0x6: "スポーツ", 0x7: "ドキュメンタリー全般",
+		0x8: "インタビュー・討論", 0xf: "その他",
+	},
+	0x9: {
+		0x0: "現代劇・新劇", 0x1: "ミュージカル", 0x2: "ダンス・バレエ", 0x3: "落語・演芸",
+		0x4: "歌舞伎・古典", 0xf: "その他",
+	},
+	0xa: {
+		0x0: "旅・釣り・アウトドア", 0x1: "園芸・ペット・手芸", 0x2: "音楽・美術・工芸", 0x3: "囲碁・将棋",
+		0x4: "麻雀・パチンコ", 0x5: "車・オートバイ", 0x6: "コンピュータ・TVゲーム", 0x7: "会話・語学",
+		0x8: "幼児・小学生", 0x9: "中学生・高校生", 0xa: "大学生・受験", 0xb: "生涯教育・資格",
+		0xc: "教育問題", 0xf: "その他",
+	},
+	0xb: {
+		0x0: "高齢者", 0x1: "障害者", 0x2: "社会福祉", 0x3: "ボランティア",
+		0x4: "手話", 0x5: "文字(字幕)", 0x6: "音声解説", 0xf: "その他",
+	},
+	0xe: {
+		0x0: "BS/地上デジタル放送用番組付属情報", 0x1: "広帯域CSデジタル放送用拡張", 0x3: "サーバー型番組付属情報", 0x4: "IP放送用番組付属情報",
+	},
+	0xf: {
+		0xf: "その他",
+	},
+}
+
+// subgenre of recordings without one
+const otherSubGenre = epgstation.ProgramGenreLv2(0xf)
+
+// A genrePair is a genre and its subgenre of a recording
+type genrePair struct {
+	genre    epgstation.ProgramGenreLv1
+	subGenre epgstation.ProgramGenreLv2
+}
+
+// genresOf returns every genre recordedItem carries, without duplicates
+func genresOf(recordedItem *epgstation.RecordedItem) []genrePair {
+	var pairs []genrePair
+	for _, g := range []struct {
+		genre    *epgstation.ProgramGenreLv1
+		subGenre *epgstation.ProgramGenreLv2
+	}{
+		{recordedItem.Genre1, recordedItem.SubGenre1},
+		{recordedItem.Genre2, recordedItem.SubGenre2},
+		{recordedItem.Genre3, recordedItem.SubGenre3},
+	} {
+		if g.genre == nil {
+			continue
+		}
+		pair := genrePair{genre: *g.genre, subGenre: otherSubGenre}
+		if g.subGenre != nil {
+			pair.subGenre = *g.subGenre
+		}
+		duplicated := false
+		for _, p := range pairs {
+			duplicated = duplicated || p == pair
+		}
+		if !duplicated {
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
+
+func subGenreContainerID(pair genrePair) ObjectID {
+	return childID(genreContainerID(pair.genre), int(pair.subGenre))
+}
+
+// subGenreName returns name of pair, or its genre if subgenre is unknown
+func subGenreName(pair genrePair) string {
+	if name, ok := subGenreIdNameMap[pair.genre][pair.subGenre]; ok {
+		return name
+	}
+	return genreIdNameMap[pair.genre]
+}
+
+// countGenres counts recordings in each genre, or in each subgenre of genre
+// if not nil
+func countGenres(records []*epgstation.RecordedItem, genre *epgstation.ProgramGenreLv1) map[genrePair]int {
+	counts := make(map[genrePair]int)
+	for _, recordedItem := range records {
+		seen := make(map[genrePair]bool)
+		for _, pair := range genresOf(recordedItem) {
+			if genre == nil {
+				pair.subGenre = 0
+			} else if pair.genre != *genre {
+				continue
+			}
+			if !seen[pair] {
+				seen[pair] = true
+				counts[pair]++
+			}
+		}
+	}
+	return counts
+}
+
+// sortedPairs returns keys of counts in the order of genre and subgenre
+func sortedPairs(counts map[genrePair]int) []genrePair {
+	pairs := make([]genrePair, 0, len(counts))
+	for pair := range counts {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].genre != pairs[j].genre {
+			return pairs[i].genre < pairs[j].genre
+		}
+		return pairs[i].subGenre < pairs[j].subGenre
+	})
+	return pairs
+}
+
+func loadGenres(ctx context.Context, container *Container) ([]interface{}, error) {
+	records, err := recorded(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counts := countGenres(records, nil)
+	var children []interface{}
+	for _, pair := range sortedPairs(counts) {
+		child := newLazyContainer(genreContainerID(pair.genre), container.Id, genreIdNameMap[pair.genre], loadSubGenres(pair.genre), -1)
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+// loadSubGenres returns a loader of subgenres of genre
+func loadSubGenres(genre epgstation.ProgramGenreLv1) loader {
+	return func(ctx context.Context, container *Container) ([]interface{}, error) {
+		records, err := recorded(ctx)
+		if err != nil {
+			return nil, err
+		}
+		counts := countGenres(records, &genre)
+		var children []interface{}
+		for _, pair := range sortedPairs(counts) {
+			pair := pair
+			child := newLazyContainer(subGenreContainerID(pair), container.Id, subGenreName(pair), func(ctx context.Context, container *Container) ([]interface{}, error) {
+				records, err := recorded(ctx)
+				if err != nil {
+					return nil, err
+				}
+				var items []interface{}
+				for _, recordedItem := range records {
+					for _, p := range genresOf(recordedItem) {
+						if p == pair {
+							items = append(items, NewItem(container.Id, recordedItem))
+							break
+						}
+					}
+				}
+				return items, nil
+			}, counts[pair])
+			child.subset = true
+			children = append(children, child)
+		}
+		return children, nil
+	}
+}
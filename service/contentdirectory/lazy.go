@@ -0,0 +1,244 @@
+package contentdirectory
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A loader fetches children of container from EPGStation. It must not touch
+// the content tree, as it runs without holding the lock of registry.
+type loader func(ctx context.Context, container *Container) ([]interface{}, error)
+
+var cacheTTL int64 // time.Duration, accessed atomically
+
+// how long resolving a container may take. Requests for the container wait
+// for the one resolving it, so a hung EPGStation must not hold it forever.
+const resolveTimeout = time.Minute
+
+// setCacheTTL changes how long resolved children of containers are used
+func setCacheTTL(d time.Duration) {
+	atomic.StoreInt64(&cacheTTL, int64(d))
+}
+
+// loadLocks serializes resolution of each container, so that concurrent
+// requests for the same container fetch it only once. Entries are dropped
+// when no request resolves the container.
+var loadLocks = struct {
+	sync.Mutex
+	m map[ObjectID]*loadLockEntry
+}{m: make(map[ObjectID]*loadLockEntry)}
+
+type loadLockEntry struct {
+	sync.Mutex
+	// number of requests holding or waiting for the lock
+	n int
+}
+
+// lockLoad locks resolution of container id, and returns the function to
+// unlock it
+func lockLoad(id ObjectID) func() {
+	loadLocks.Lock()
+	l, ok := loadLocks.m[id]
+	if !ok {
+		l = new(loadLockEntry)
+		loadLocks.m[id] = l
+	}
+	l.n++
+	loadLocks.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		loadLocks.Lock()
+		l.n--
+		if l.n == 0 {
+			delete(loadLocks.m, id)
+		}
+		loadLocks.Unlock()
+	}
+}
+
+// fresh reports whether children of c can be used as is. Caller must hold
+// the lock of registry.
+func (c *Container) fresh() bool {
+	return c.loader == nil || (!c.loadedAt.IsZero() && time.Since(c.loadedAt) < time.Duration(atomic.LoadInt64(&cacheTTL)))
+}
+
+// resolve fetches children of container id unless they are fresh. When
+// fetching fails, children fetched before are kept. Caller must not hold
+// the lock of registry.
+func resolve(ctx context.Context, id ObjectID) error {
+	for {
+		retry, err := resolveOnce(ctx, id)
+		if !retry {
+			return err
+		}
+	}
+}
+
+// resolveOnce resolves container id as resolve does. It returns true to
+// retry, when the container is replaced while loading.
+func resolveOnce(ctx context.Context, id ObjectID) (bool, error) {
+	registry.RLock()
+	c, ok := registry.container(id)
+	fresh := !ok || c.fresh()
+	registry.RUnlock()
+	if fresh {
+		return false, nil
+	}
+
+	unlock := lockLoad(id)
+	defer unlock()
+	registry.RLock()
+	// may be resolved by another request while waiting
+	fresh, stale := c.fresh(), c.Children != nil
+	registry.RUnlock()
+	if fresh {
+		return false, nil
+	}
+
+	loadCtx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	children, err := c.loader(loadCtx, c)
+	if err != nil {
+		log.Printf("Resolving container %s failed: %s", id, err)
+		if stale {
+			return false, nil
+		}
+		return false, err
+	}
+	registry.Lock()
+	if current, ok := registry.container(id); !ok || current != c {
+		// dropped by Rebuild or resolution of its parent while loading, so
+		// children loaded may be stale and must not be registered
+		registry.Unlock()
+		return ok, nil
+	}
+	changed := publish(c, children)
+	registry.Unlock()
+	if changed {
+		notifyUpdated(c.Id)
+	}
+	return false, nil
+}
+
+// resolvePath resolves ancestors of id unless it is known, so that objects
+// remembered by clients are found without browsing down from the root.
+func resolvePath(ctx context.Context, id ObjectID) error {
+	registry.RLock()
+	_, ok := registry.object(id)
+	registry.RUnlock()
+	if ok || id == "0" {
+		return nil
+	}
+	parentID := parentIDOf(id)
+	if err := resolvePath(ctx, parentID); err != nil {
+		return err
+	}
+	return resolve(ctx, parentID)
+}
+
+// resolveSubtree resolves containers under id for Search. When skipSubsets,
+// containers having only items also in 録画済み are not resolved.
+func resolveSubtree(ctx context.Context, id ObjectID, skipSubsets bool) error {
+	if err := resolve(ctx, id); err != nil {
+		return err
+	}
+	var ids []ObjectID
+	registry.RLock()
+	if c, ok := registry.container(id); ok {
+		for _, child := range c.Children {
+			if child, ok := child.(*Container); ok && !(skipSubsets && child.subset) {
+				ids = append(ids, child.Id)
+			}
+		}
+	}
+	registry.RUnlock()
+	for _, id := range ids {
+		if err := resolveSubtree(ctx, id, skipSubsets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish replaces children of c with resolved ones and registers them.
+// Child containers already known are kept with their children, only title
+// and count updated. It returns whether children changed since the last
+// resolution. Caller must hold the write lock of registry.
+func publish(c *Container, children []interface{}) bool {
+	known := make(map[ObjectID]*Container)
+	for _, child := range c.Children {
+		if child, ok := child.(*Container); ok {
+			known[child.Id] = child
+			continue
+		}
+		unregister(child)
+	}
+	for i, child := range children {
+		switch child := child.(type) {
+		case *Container:
+			if prev, ok := known[child.Id]; ok {
+				prev.Title, prev.countHint = child.Title, child.countHint
+				children[i] = prev
+				delete(known, child.Id)
+				continue
+			}
+			registry.objects[child.Id] = child
+		case *Item:
+			registry.register(child)
+		}
+	}
+	for _, child := range known {
+		unregister(child)
+	}
+	if children == nil {
+		children = make([]interface{}, 0)
+	}
+	c.Children = children
+	c.loadedAt = time.Now()
+	signature := containerSignature(c)
+	changed := c.signature != 0 && c.signature != signature
+	c.signature = signature
+	return changed
+}
+
+// unregister removes object and its descendants from registry, unless an
+// object of the same id in other container is registered. Caller must hold
+// the write lock of registry.
+func unregister(object interface{}) {
+	switch object := object.(type) {
+	case *Container:
+		for _, child := range object.Children {
+			unregister(child)
+		}
+		if registry.objects[object.Id] == object {
+			delete(registry.objects, object.Id)
+		}
+	case *Item:
+		if registry.objects[object.Id] == object {
+			delete(registry.objects, object.Id)
+		}
+	}
+}
+
+// invalidate makes children of containers of ids fetched again on next
+// access, and notifies the change. Unknown ids are ignored.
+func invalidate(ids ...ObjectID) {
+	var invalidated []ObjectID
+	registry.Lock()
+	for _, id := range ids {
+		if c, ok := registry.container(id); ok && c.loader != nil {
+			c.loadedAt = time.Time{}
+			// changes are notified here, not on next resolution
+			c.signature = 0
+			invalidated = append(invalidated, id)
+		}
+	}
+	registry.Unlock()
+	if len(invalidated) > 0 {
+		notifyUpdated(invalidated...)
+	}
+}
@@ -0,0 +1,189 @@
+package contentdirectory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+	"upnp-mediaserver/config"
+	"upnp-mediaserver/epgstation"
+)
+
+// ライブ lists channels of EPGStation to watch live broadcasts, titled with
+// programs on air, which are updated as programs end.
+
+// order and titles of containers of channel types in ライブ
+var liveChannelTypes = []struct {
+	channelType epgstation.ChannelType
+	title       string
+}{
+	{epgstation.ChannelTypeGR, "地上波"},
+	{epgstation.ChannelTypeBS, "BS"},
+	{epgstation.ChannelTypeCS, "CS"},
+	{epgstation.ChannelTypeSKY, "スカパー"},
+}
+
+// live broadcasts can not be seeked, nor be paused for long
+const dlnaFlagsLive = "01100000000000000000000000000000"
+
+var liveFormats = map[string]videoFormat{
+	"m2ts": {mime: "video/mpeg", op: "00", ci: "0", flags: dlnaFlagsLive},
+	"mp4":  {mime: "video/mp4", op: "00", ci: "1", flags: dlnaFlagsLive},
+	"webm": {mime: "video/webm", op: "00", ci: "1", flags: dlnaFlagsLive},
+}
+
+var liveStream atomic.Value // config.StreamMode
+
+// LiveStream returns streaming setting of EPGStation to watch live broadcasts
+func LiveStream() config.StreamMode {
+	mode, ok := liveStream.Load().(config.StreamMode)
+	if !ok {
+		return config.DefaultLiveStream
+	}
+	return mode
+}
+
+// LiveContentFeatures returns contentFeatures.dlna.org of live broadcasts
+func LiveContentFeatures() string {
+	return liveFormats[LiveStream().Container].contentFeatures(false)
+}
+
+// LookupChannel returns the channel of id, fetching channels if not yet
+func LookupChannel(ctx context.Context, id epgstation.ChannelId) (epgstation.ChannelItem, bool) {
+	prepareChannels(ctx)
+	return channelItem(id)
+}
+
+func channelTypeContainerID(channelType epgstation.ChannelType) ObjectID {
+	return childID(liveContainerID, channelType)
+}
+
+// liveExpiry keeps when titles of items in containers of ライブ get stale,
+// that is the earliest end of programs on air when resolved
+var liveExpiry = struct {
+	sync.Mutex
+	m map[ObjectID]time.Time
+}{m: make(map[ObjectID]time.Time)}
+
+// expireLive invalidates containers of ライブ whose programs on air ended
+func expireLive() {
+	now := time.Now()
+	var ids []ObjectID
+	liveExpiry.Lock()
+	for id, expiry := range liveExpiry.m {
+		if now.After(expiry) {
+			ids = append(ids, id)
+			delete(liveExpiry.m, id)
+		}
+	}
+	liveExpiry.Unlock()
+	if len(ids) > 0 {
+		invalidate(ids...)
+	}
+}
+
+func loadLive(ctx context.Context, container *Container) ([]interface{}, error) {
+	channelItems, err := getChannels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[epgstation.ChannelType]int)
+	for _, channelItem := range channelItems {
+		counts[channelItem.ChannelType]++
+	}
+	var children []interface{}
+	for _, t := range liveChannelTypes {
+		if counts[t.channelType] == 0 {
+			continue
+		}
+		child := newLazyContainer(channelTypeContainerID(t.channelType), container.Id, t.title, loadLiveChannels(t.channelType), counts[t.channelType])
+		// nothing to search, as no recordings are there
+		child.subset = true
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+// loadLiveChannels returns a loader of channels of channelType
+func loadLiveChannels(channelType epgstation.ChannelType) loader {
+	return func(ctx context.Context, container *Container) ([]interface{}, error) {
+		channelItems, err := getChannels(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res, err := epgstation.EPGStation().GetSchedulesBroadcastingWithResponse(ctx, &epgstation.GetSchedulesBroadcastingParams{
+			IsHalfWidth: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if res.JSON200 == nil {
+			return nil, fmt.Errorf("GetSchedulesBroadcasting: %s", res.Status())
+		}
+		onAir := make(map[epgstation.ChannelId]*epgstation.ScheduleProgramItem)
+		for _, schedule := range *res.JSON200 {
+			if len(schedule.Programs) > 0 {
+				onAir[schedule.Channel.Id] = &schedule.Programs[0]
+			}
+		}
+
+		var items []interface{}
+		var expiry time.Time
+		for _, channelItem := range channelItems {
+			if channelItem.ChannelType != channelType {
+				continue
+			}
+			program := onAir[channelItem.Id]
+			items = append(items, newLiveItem(container.Id, channelItem, program))
+			if program != nil {
+				if end := time.UnixMilli(int64(program.EndAt)); expiry.IsZero() || end.Before(expiry) {
+					expiry = end
+				}
+			}
+		}
+		liveExpiry.Lock()
+		if expiry.IsZero() {
+			delete(liveExpiry.m, container.Id)
+		} else {
+			liveExpiry.m[container.Id] = expiry
+		}
+		liveExpiry.Unlock()
+		return items, nil
+	}
+}
+
+// newLiveItem returns item of channelItem to be a child of container
+// ParentID, titled with program on air if any
+func newLiveItem(ParentID ObjectID, channelItem epgstation.ChannelItem, program *epgstation.ScheduleProgramItem) *Item {
+	mode := LiveStream()
+	channelNr := int(channelItem.ServiceId)
+	item := &Item{
+		Id:         childID(ParentID, channelItem.Id),
+		ParentID:   ParentID,
+		Title:      channelItem.HalfWidthName,
+		Class:      "object.item.videoItem.videoBroadcast",
+		Restricted: "true",
+
+		Resources: &[]Res{{
+			ProtocolInfo: liveFormats[mode.Container].protocolInfo(false),
+			URL:          fmt.Sprintf("%svideos/live?channelId=%d", serviceURLBase, channelItem.Id),
+			Resolution:   mode.Resolution,
+			live:         true,
+		}},
+
+		ChannelName: &channelItem.HalfWidthName,
+		ChannelNr:   &channelNr,
+	}
+	if program != nil {
+		start := time.UnixMilli(int64(program.StartAt)).In(currentLocation())
+		end := time.UnixMilli(int64(program.EndAt)).In(currentLocation())
+		item.Title = program.Name
+		item.Date = start.Format(dateTimeFormat)
+		item.Description = program.Description
+		item.LongDescription = program.Extended
+		item.ScheduledStartTime = start.Format(dateTimeFormat)
+		item.ScheduledEndTime = end.Format(dateTimeFormat)
+	}
+	return item
+}
@@ -0,0 +1,229 @@
+package contentdirectory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"sync"
+	"upnp-mediaserver/epgstation"
+)
+
+// A recording is a recorded program seen on the last refresh
+type recording struct {
+	fingerprint uint64
+	item        epgstation.RecordedItem
+}
+
+// refreshMu guards recordings and tagsFingerprint, replaced by refresh and
+// Rebuild. It is not held while fetching, not to block resolving containers.
+var refreshMu sync.Mutex
+
+// recordings seen on the last refresh, nil until the first refresh after Rebuild
+var recordings map[epgstation.RecordedId]*recording
+
+// digest of tags seen on the last refresh, to notice tags added, renamed or removed
+var tagsFingerprint uint64
+
+// fingerprint digests properties of recordedItem which affect the content
+// tree, so that a recording is updated only when some of them changed.
+func fingerprint(recordedItem *epgstation.RecordedItem) uint64 {
+	digest := epgstation.RecordedItem{
+		Id:          recordedItem.Id,
+		Name:        recordedItem.Name,
+		Description: recordedItem.Description,
+		Extended:    recordedItem.Extended,
+		ChannelId:   recordedItem.ChannelId,
+		RuleId:      recordedItem.RuleId,
+		StartAt:     recordedItem.StartAt,
+		EndAt:       recordedItem.EndAt,
+		Genre1:      recordedItem.Genre1,
+		SubGenre1:   recordedItem.SubGenre1,
+		Genre2:      recordedItem.Genre2,
+		SubGenre2:   recordedItem.SubGenre2,
+		Genre3:      recordedItem.Genre3,
+		SubGenre3:   recordedItem.SubGenre3,
+		IsRecording: recordedItem.IsRecording,
+		IsEncoding:  recordedItem.IsEncoding,
+		Tags:        recordedItem.Tags,
+		Thumbnails:  recordedItem.Thumbnails,
+		VideoFiles:  recordedItem.VideoFiles,
+	}
+	data, _ := json.Marshal(digest)
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+// containersOf adds ids of containers listing recordedItem, or counting it
+// in titles of children, to ids
+func containersOf(recordedItem *epgstation.RecordedItem, ids map[ObjectID]bool) {
+	if recordedItem.IsRecording {
+		// listed only in 録画中 until recording finishes
+		ids[recordingContainerID] = true
+		return
+	}
+	ids[recordedContainerID] = true
+	for _, pair := range genresOf(recordedItem) {
+		ids[genresContainerID] = true
+		ids[genreContainerID(pair.genre)] = true
+		ids[subGenreContainerID(pair)] = true
+	}
+	if recordedItem.ChannelId != nil {
+		ids[channelsContainerID] = true
+		ids[channelContainerID(*recordedItem.ChannelId)] = true
+	}
+	if recordedItem.RuleId != nil {
+		ids[rulesContainerID] = true
+		ids[ruleContainerID(*recordedItem.RuleId)] = true
+	}
+	if recordedItem.Tags != nil {
+		for _, tag := range *recordedItem.Tags {
+			ids[tagsContainerID] = true
+			ids[tagContainerID(tag.Id)] = true
+		}
+	}
+	t := startTime(recordedItem)
+	for _, id := range []ObjectID{seriesContainerID, seriesID(recordedItem), datesContainerID, yearContainerID(t), monthContainerID(t), dayContainerID(t), weekdaysContainerID, weekdayContainerID(t.Weekday())} {
+		ids[id] = true
+	}
+}
+
+// recorded returns every finished recording seen on the last refresh, newest
+// first. It fetches them from EPGStation if not refreshed yet.
+func recorded(ctx context.Context) ([]*epgstation.RecordedItem, error) {
+	prepareChannels(ctx)
+	refreshMu.Lock()
+	var records []*epgstation.RecordedItem
+	for _, r := range recordings {
+		// never mutated, as replaced on refresh
+		records = append(records, &r.item)
+	}
+	refreshed := recordings != nil
+	refreshMu.Unlock()
+	if !refreshed {
+		it := epgstation.IterateRecorded(ctx, epgstation.GetRecordedParams{})
+		for it.Next() {
+			records = append(records, it.Value())
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+	// listed only in 録画中 until recording finishes
+	finished := records[:0]
+	for _, recordedItem := range records {
+		if !recordedItem.IsRecording {
+			finished = append(finished, recordedItem)
+		}
+	}
+	records = finished
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].StartAt != records[j].StartAt {
+			return records[i].StartAt > records[j].StartAt
+		}
+		return records[i].Id > records[j].Id
+	})
+	return records, nil
+}
+
+// numRecordings returns the number of recordings seen on the last refresh
+func numRecordings() int {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	return len(recordings)
+}
+
+// refresh fetches every recording from EPGStation and invalidates containers
+// listing recordings added, updated or removed since the last refresh. It
+// returns the number of recordings.
+//
+// Only containers already resolved are fetched again, on next access. It must
+// not be called concurrently, as Watch does.
+func refresh(ctx context.Context) (int, error) {
+	it := epgstation.IterateRecorded(ctx, epgstation.GetRecordedParams{
+		IsHalfWidth: false,
+	})
+	records, err := it.All()
+	if err != nil {
+		return numRecordings(), err
+	}
+
+	current := make(map[epgstation.RecordedId]*recording)
+	for i := range records {
+		recordedItem := &records[i]
+		if _, ok := current[recordedItem.Id]; ok {
+			// shifted to the next page by a recording added while paging
+			continue
+		}
+		current[recordedItem.Id] = &recording{fingerprint: fingerprint(recordedItem), item: *recordedItem}
+	}
+	if len(current) != it.Total() {
+		// some may be shifted to the previous page by a recording removed while paging
+		return numRecordings(), fmt.Errorf("recordings changed while fetching, %d fetched out of %d", len(current), it.Total())
+	}
+	tags, err := epgstation.IterateTags(ctx, epgstation.GetTagsParams{}).All()
+	if err != nil {
+		return numRecordings(), err
+	}
+	data, _ := json.Marshal(tags)
+	h := fnv.New64a()
+	h.Write(data)
+
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	prevTagsFingerprint := tagsFingerprint
+	tagsFingerprint = h.Sum64()
+	if recordings == nil {
+		// containers resolved so far are as fresh as the baseline
+		recordings = current
+		return len(recordings), nil
+	}
+
+	affected := make(map[ObjectID]bool)
+	if tagsFingerprint != prevTagsFingerprint {
+		affected[tagsContainerID] = true
+	}
+	var changed, removed int
+	for id, r := range current {
+		prev, ok := recordings[id]
+		if ok && prev.fingerprint == r.fingerprint {
+			continue
+		}
+		changed++
+		containersOf(&r.item, affected)
+		if ok {
+			containersOf(&prev.item, affected)
+		}
+	}
+	registry.Lock()
+	for id, prev := range recordings {
+		if _, ok := current[id]; ok {
+			continue
+		}
+		removed++
+		containersOf(&prev.item, affected)
+		if prev.item.VideoFiles == nil {
+			// EPGStation omits videoFiles of recordings having no files
+			continue
+		}
+		for _, videoFile := range *prev.item.VideoFiles {
+			delete(registry.resources, videoFile.Id)
+		}
+	}
+	registry.Unlock()
+	recordings = current
+	if len(affected) == 0 {
+		return len(recordings), nil
+	}
+
+	log.Printf("Refresh ContentDirectory: %d added or updated, %d removed", changed, removed)
+	ids := make([]ObjectID, 0, len(affected))
+	for id := range affected {
+		ids = append(ids, id)
+	}
+	invalidate(ids...)
+	return len(recordings), nil
+}
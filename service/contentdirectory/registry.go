@@ -0,0 +1,118 @@
+package contentdirectory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"upnp-mediaserver/epgstation"
+)
+
+// A Registry indexes objects of the content tree by object id, and resources
+// of items by video file id.
+//
+// The content tree is shared between the refresher and SOAP handlers, so
+// objects reachable from the registry, including Children of containers,
+// are mutated only while holding the write lock, and read only while holding
+// the read lock. Resource values are never mutated once registered.
+type Registry struct {
+	sync.RWMutex
+	objects   map[ObjectID]interface{}
+	resources map[epgstation.VideoFileId]*Resource
+}
+
+// A Resource is a video file of a recording listed in the content tree, for
+// endpoints serving it
+type Resource struct {
+	Recorded     *epgstation.RecordedItem
+	VideoFile    epgstation.VideoFile
+	Duration     time.Duration
+	Size         int
+	ProtocolInfo string
+	// being recorded, so that Size and Duration are unknown
+	Recording bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		objects:   make(map[ObjectID]interface{}),
+		resources: make(map[epgstation.VideoFileId]*Resource),
+	}
+}
+
+var registry = NewRegistry()
+
+// reset unregisters every object and resource. Caller must hold the write lock.
+func (r *Registry) reset() {
+	r.objects = make(map[ObjectID]interface{})
+	r.resources = make(map[epgstation.VideoFileId]*Resource)
+}
+
+// object returns the object of id. Caller must hold the lock.
+func (r *Registry) object(id ObjectID) (interface{}, bool) {
+	object, ok := r.objects[id]
+	return object, ok
+}
+
+// container returns the container of id. Caller must hold the lock.
+func (r *Registry) container(id ObjectID) (*Container, bool) {
+	container, ok := r.objects[id].(*Container)
+	return container, ok
+}
+
+// Progress returns how long and how many bytes of the resource are recorded
+// so far, and whether it is still being recorded. It asks EPGStation unless
+// recording finished when listed.
+func (r *Resource) Progress(ctx context.Context) (time.Duration, int, bool, error) {
+	if !r.Recording {
+		return r.Duration, r.Size, false, nil
+	}
+	res, err := epgstation.EPGStation().GetRecordedRecordedIdWithResponse(ctx, epgstation.PathRecordedId(r.Recorded.Id), &epgstation.GetRecordedRecordedIdParams{})
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if res.JSON200 == nil {
+		return 0, 0, false, fmt.Errorf("GetRecordedRecordedId: %s", res.Status())
+	}
+	recordedItem := res.JSON200
+	end := time.UnixMilli(int64(recordedItem.EndAt))
+	if recordedItem.IsRecording && time.Now().Before(end) {
+		end = time.Now()
+	}
+	duration := end.Sub(time.UnixMilli(int64(recordedItem.StartAt)))
+	if recordedItem.VideoFiles != nil {
+		for _, videoFile := range *recordedItem.VideoFiles {
+			if videoFile.Id == r.VideoFile.Id {
+				return duration, videoFile.Size, recordedItem.IsRecording, nil
+			}
+		}
+	}
+	return 0, 0, false, fmt.Errorf("video file %d is not found in recorded %d", r.VideoFile.Id, recordedItem.Id)
+}
+
+// resource returns the resource of videoFileId. Caller must hold the lock.
+func (r *Registry) resource(videoFileId epgstation.VideoFileId) (*Resource, bool) {
+	resource, ok := r.resources[videoFileId]
+	return resource, ok
+}
+
+// register registers item and its resources. Caller must hold the write lock.
+func (r *Registry) register(item *Item) {
+	r.objects[item.Id] = item
+	if item.Resources == nil {
+		return
+	}
+	for _, res := range *item.Resources {
+		if res.transcoded || res.thumbnail || res.live {
+			continue
+		}
+		r.resources[res.videoFile.Id] = &Resource{
+			Recorded:     item.recorded,
+			VideoFile:    res.videoFile,
+			Duration:     res.DurationNS,
+			Size:         res.Size,
+			ProtocolInfo: res.ProtocolInfo,
+			Recording:    res.recording,
+		}
+	}
+}
@@ -0,0 +1,467 @@
+package contentdirectory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+
+	"upnp-mediaserver/epgstation"
+)
+
+var ErrInvalidSearchCriteria = errors.New("invalid search criteria")
+
+// SearchCapabilities is the list of properties which can be used in
+// SearchCriteria. Other properties are accepted, but match no objects.
+var SearchCapabilities = []string{
+	"@id",
+	"@parentID",
+	"@refID",
+	"dc:title",
+	"dc:description",
+	"upnp:class",
+	"upnp:genre",
+	"dc:date",
+	"upnp:channelName",
+}
+
+// searchExp is a node of parsed SearchCriteria described in ContentDirectory:1 section 2.5.5
+type searchExp interface {
+	match(object interface{}) bool
+}
+
+type matchAll struct{}
+
+func (matchAll) match(object interface{}) bool { return true }
+
+type andExp struct{ left, right searchExp }
+
+func (e andExp) match(object interface{}) bool { return e.left.match(object) && e.right.match(object) }
+
+type orExp struct{ left, right searchExp }
+
+func (e orExp) match(object interface{}) bool { return e.left.match(object) || e.right.match(object) }
+
+type relExp struct {
+	property string
+	op       string
+	value    string
+}
+
+func (e relExp) match(object interface{}) bool {
+	values := propertyValues(object, e.property)
+	value := strings.ToLower(e.value)
+	if e.op == "!=" || e.op == "doesNotContain" {
+		// negative operators hold when no value of the property is matched
+		for _, v := range values {
+			v = strings.ToLower(v)
+			if (e.op == "!=" && v == value) || (e.op == "doesNotContain" && strings.Contains(v, value)) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		v = strings.ToLower(v)
+		var ok bool
+		switch e.op {
+		case "=":
+			ok = v == value
+		case "<":
+			ok = v < value
+		case "<=":
+			ok = v <= value
+		case ">":
+			ok = v > value
+		case ">=":
+			ok = v >= value
+		case "contains":
+			ok = strings.Contains(v, value)
+		case "derivedfrom":
+			ok = v == value || strings.HasPrefix(v, value+".")
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+type existsExp struct {
+	property string
+	exists   bool
+}
+
+func (e existsExp) match(object interface{}) bool {
+	return (len(propertyValues(object, e.property)) > 0) == e.exists
+}
+
+// propertyValues returns values of property of object. Multi-valued property like upnp:genre may have several values.
+func propertyValues(object interface{}, property string) []string {
+	var values []string
+	switch object := object.(type) {
+	case *Container:
+		switch property {
+		case "@id":
+			values = append(values, string(object.Id))
+		case "@parentID":
+			values = append(values, string(object.ParentID))
+		case "dc:title":
+			values = append(values, object.Title)
+		case "upnp:class":
+			values = append(values, object.Class)
+		}
+	case *Item:
+		switch property {
+		case "@id":
+			values = append(values, string(object.Id))
+		case "@parentID":
+			values = append(values, string(object.ParentID))
+		case "@refID":
+			if object.RefID != nil {
+				values = append(values, string(*object.RefID))
+			}
+		case "dc:title":
+			values = append(values, object.Title)
+		case "upnp:class":
+			values = append(values, object.Class)
+		case "dc:date":
+			if object.Date != "" {
+				// date only as well, for criteria like dc:date = "2006-01-02"
+				values = append(values, object.Date, object.Date[:len("2006-01-02")])
+			}
+		case "dc:description":
+			if object.Description != nil {
+				values = append(values, *object.Description)
+			}
+		case "upnp:genre":
+			values = append(values, object.Genres...)
+		case "upnp:channelName":
+			if object.ChannelName != nil {
+				values = append(values, *object.ChannelName)
+			}
+			// full width name as well, for criteria typed so
+			if object.recorded != nil && object.recorded.ChannelId != nil {
+				if channel, ok := channelItem(*object.recorded.ChannelId); ok {
+					values = append(values, channel.Name)
+				}
+			}
+		}
+	}
+	return values
+}
+
+type searchToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeSearchCriteria(criteria string) ([]searchToken, error) {
+	var tokens []searchToken
+	runes := []rune(criteria)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, searchToken{text: string(r)})
+			i++
+		case r == '"':
+			var sb strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				sb.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("%w: unterminated quoted value", ErrInvalidSearchCriteria)
+			}
+			i++ // closing quote
+			tokens = append(tokens, searchToken{text: sb.String(), quoted: true})
+		case r == '=' || r == '!' || r == '<' || r == '>':
+			op := string(r)
+			i++
+			if i < len(runes) && runes[i] == '=' {
+				op += "="
+				i++
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("%w: unknown operator !", ErrInvalidSearchCriteria)
+			}
+			tokens = append(tokens, searchToken{text: op})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`()"=!<>`, runes[i]) {
+				i++
+			}
+			tokens = append(tokens, searchToken{text: string(runes[start:i])})
+		}
+	}
+	return tokens, nil
+}
+
+type searchParser struct {
+	tokens []searchToken
+	pos    int
+}
+
+func (p *searchParser) peek() *searchToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *searchParser) next() (searchToken, error) {
+	if p.pos >= len(p.tokens) {
+		return searchToken{}, fmt.Errorf("%w: unexpected end", ErrInvalidSearchCriteria)
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+// parseOr parses `searchExp or searchExp`. `and` binds tighter than `or`
+func (p *searchParser) parseOr() (searchExp, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t != nil && !t.quoted && strings.EqualFold(t.text, "or"); t = p.peek() {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExp{left, right}
+	}
+	return left, nil
+}
+
+func (p *searchParser) parseAnd() (searchExp, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t != nil && !t.quoted && strings.EqualFold(t.text, "and"); t = p.peek() {
+		p.pos++
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		left = andExp{left, right}
+	}
+	return left, nil
+}
+
+func (p *searchParser) parsePrimary() (searchExp, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if !t.quoted && t.text == "(" {
+		exp, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t, err := p.next(); err != nil || t.quoted || t.text != ")" {
+			return nil, fmt.Errorf("%w: missing )", ErrInvalidSearchCriteria)
+		}
+		return exp, nil
+	}
+	// unknown properties are not errors, as clients ask ones of their own
+	// like upnp:artist. They have no values as properties objects lack.
+	property := t.text
+	if t.quoted || t.text == ")" {
+		return nil, fmt.Errorf("%w: property expected but got %s", ErrInvalidSearchCriteria, property)
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if op.quoted {
+		return nil, fmt.Errorf("%w: operator expected but got \"%s\"", ErrInvalidSearchCriteria, op.text)
+	}
+	switch op.text {
+	case "exists":
+		if value.quoted || (value.text != "true" && value.text != "false") {
+			return nil, fmt.Errorf("%w: exists requires true or false", ErrInvalidSearchCriteria)
+		}
+		return existsExp{property: property, exists: value.text == "true"}, nil
+	case "=", "!=", "<", "<=", ">", ">=", "contains", "doesNotContain", "derivedfrom":
+		if !value.quoted {
+			return nil, fmt.Errorf("%w: quoted value expected but got %s", ErrInvalidSearchCriteria, value.text)
+		}
+		return relExp{property: property, op: op.text, value: value.text}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown operator %s", ErrInvalidSearchCriteria, op.text)
+	}
+}
+
+func parseSearchCriteria(criteria string) (searchExp, error) {
+	if strings.TrimSpace(criteria) == "*" {
+		return matchAll{}, nil
+	}
+	tokens, err := tokenizeSearchCriteria(criteria)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidSearchCriteria)
+	}
+	p := &searchParser{tokens: tokens}
+	exp, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(tokens) {
+		return nil, fmt.Errorf("%w: unexpected %s", ErrInvalidSearchCriteria, tokens[p.pos].text)
+	}
+	return exp, nil
+}
+
+// extractTitleKeyword finds `dc:title contains "keyword"` which must hold for
+// whole expression, then returns the keyword and the expression without it.
+func extractTitleKeyword(exp searchExp) (string, searchExp) {
+	switch e := exp.(type) {
+	case relExp:
+		if e.property == "dc:title" && e.op == "contains" && e.value != "" {
+			return e.value, matchAll{}
+		}
+	case andExp:
+		if keyword, rest := extractTitleKeyword(e.left); keyword != "" {
+			return keyword, andExp{rest, e.right}
+		}
+		if keyword, rest := extractTitleKeyword(e.right); keyword != "" {
+			return keyword, andExp{e.left, rest}
+		}
+	}
+	return "", exp
+}
+
+// recordedIdsByKeyword asks EPGStation recordings whose title matches keyword
+func recordedIdsByKeyword(ctx context.Context, keyword string) (map[epgstation.RecordedId]bool, error) {
+	queryKeyword := epgstation.QueryKeyword(keyword)
+	it := epgstation.IterateRecorded(ctx, epgstation.GetRecordedParams{
+		IsHalfWidth: false,
+		Keyword:     &queryKeyword,
+	})
+	ids := make(map[epgstation.RecordedId]bool)
+	for it.Next() {
+		ids[it.Value().Id] = true
+	}
+	return ids, it.Err()
+}
+
+// collectMatches walks the tree under container and appends containers matching exp
+// and items matching itemExp (and included in recordedIds if not nil).
+// The same recording appearing in several containers is returned only once.
+// When skipSubsets, items of subset containers are not walked, as they are
+// found in 録画済み anyway.
+func collectMatches(container *Container, exp searchExp, itemExp searchExp, recordedIds map[epgstation.RecordedId]bool, skipSubsets bool, seen map[interface{}]bool, matches []interface{}) []interface{} {
+	for _, child := range container.Children {
+		switch child := child.(type) {
+		case *Container:
+			if !seen[child.Id] && exp.match(child) {
+				seen[child.Id] = true
+				matches = append(matches, child)
+			}
+			if !(skipSubsets && child.subset) {
+				matches = collectMatches(child, exp, itemExp, recordedIds, skipSubsets, seen, matches)
+			}
+		case *Item:
+			if child.recorded == nil || seen[child.recorded.Id] {
+				continue
+			}
+			if recordedIds != nil && !recordedIds[child.recorded.Id] {
+				continue
+			}
+			if itemExp.match(child) {
+				seen[child.recorded.Id] = true
+				matches = append(matches, child)
+			}
+		}
+	}
+	return matches
+}
+
+// lookupSearchContainer returns the container of containerID. Caller must
+// hold the lock of registry.
+func lookupSearchContainer(containerID string) (*Container, error) {
+	object, ok := registry.object(ObjectID(containerID))
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchObject, containerID)
+	}
+	container, ok := object.(*Container)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not a container", ErrNoSuchObject, containerID)
+	}
+	return container, nil
+}
+
+// Search returns DIDL-Lite of objects under containerID matching criteria,
+// with the number of returned objects and total matches.
+func Search(ctx context.Context, containerID string, criteria string, filter string, SortCriteria string, StartingIndex int, RequestedCount int) (string, int, int, error) {
+	if err := resolvePath(ctx, ObjectID(containerID)); err != nil {
+		return "", 0, 0, err
+	}
+	registry.RLock()
+	_, err := lookupSearchContainer(containerID)
+	registry.RUnlock()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	exp, err := parseSearchCriteria(criteria)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	// validate before asking EPGStation
+	if _, err := parseSortCriteria(SortCriteria); err != nil {
+		return "", 0, 0, err
+	}
+	// searching from root, every recording is found in 録画済み without resolving other containers
+	skipSubsets := containerID == "0"
+	if err := resolveSubtree(ctx, ObjectID(containerID), skipSubsets); err != nil {
+		return "", 0, 0, err
+	}
+
+	// leave title matching of recordings to EPGStation, which knows better about full/half width and so on
+	itemExp := exp
+	var recordedIds map[epgstation.RecordedId]bool
+	if keyword, rest := extractTitleKeyword(exp); keyword != "" {
+		recordedIds, err = recordedIdsByKeyword(ctx, keyword)
+		if err != nil {
+			log.Printf("keyword search on EPGStation failed: %s", err)
+			return "", 0, 0, err
+		}
+		itemExp = rest
+	}
+
+	registry.RLock()
+	defer registry.RUnlock()
+	// looked up again, as the tree may be updated while asking EPGStation
+	container, err := lookupSearchContainer(containerID)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	matches := collectMatches(container, exp, itemExp, recordedIds, skipSubsets, make(map[interface{}]bool), nil)
+	matches, err = sortObjects(matches, SortCriteria)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	start, end := paginate(len(matches), StartingIndex, RequestedCount)
+	result, err := marshalDIDLLite(matches[start:end], ParseFilter(filter))
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return result, end - start, len(matches), nil
+}
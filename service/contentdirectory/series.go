@@ -0,0 +1,154 @@
+package contentdirectory
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"upnp-mediaserver/epgstation"
+)
+
+type seriesRules struct {
+	strip   []*regexp.Regexp
+	episode []*regexp.Regexp
+}
+
+var seriesRuleSet atomic.Value // *seriesRules
+
+// setSeriesRules changes how titles are normalized into series. strip are
+// removed from titles, and episode capture episode number.
+func setSeriesRules(strip []*regexp.Regexp, episode []*regexp.Regexp) {
+	seriesRuleSet.Store(&seriesRules{strip: strip, episode: episode})
+}
+
+func currentSeriesRules() *seriesRules {
+	if rules, ok := seriesRuleSet.Load().(*seriesRules); ok {
+		return rules
+	}
+	return &seriesRules{}
+}
+
+// toHalfWidth turns full width alphanumerics, symbols and spaces into half width
+func toHalfWidth(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= '！' && r <= '～':
+			return r - '！' + '!'
+		case r == '　':
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// seriesTitle returns title of the series of recordedItem
+func seriesTitle(recordedItem *epgstation.RecordedItem) string {
+	title := toHalfWidth(recordedItem.Name)
+	for _, re := range currentSeriesRules().strip {
+		title = re.ReplaceAllString(title, "")
+	}
+	title = strings.Join(strings.Fields(title), " ")
+	if title == "" {
+		// stripped everything, like a title of only episode number
+		return strings.TrimSpace(recordedItem.Name)
+	}
+	return title
+}
+
+// episodeNumber returns episode number in title of recordedItem, if any
+func episodeNumber(recordedItem *epgstation.RecordedItem) (int, bool) {
+	title := toHalfWidth(recordedItem.Name)
+	for _, re := range currentSeriesRules().episode {
+		if m := re.FindStringSubmatch(title); m != nil {
+			if n, err := strconv.Atoi(m[1]); err == nil {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// seriesID returns ID of the container of the series of recordedItem. Titles
+// may have any characters, so a digest of title is used as the key.
+func seriesID(recordedItem *epgstation.RecordedItem) ObjectID {
+	h := fnv.New64a()
+	h.Write([]byte(seriesTitle(recordedItem)))
+	return childID(seriesContainerID, fmt.Sprintf("%016x", h.Sum64()))
+}
+
+// sortEpisodes sorts recordings of a series by episode number, then ones
+// having no number like specials by air date
+func sortEpisodes(records []*epgstation.RecordedItem) {
+	type episode struct {
+		recordedItem *epgstation.RecordedItem
+		number       int
+		numbered     bool
+	}
+	episodes := make([]episode, len(records))
+	for i, recordedItem := range records {
+		episodes[i].recordedItem = recordedItem
+		episodes[i].number, episodes[i].numbered = episodeNumber(recordedItem)
+	}
+	sort.SliceStable(episodes, func(i, j int) bool {
+		ei, ej := episodes[i], episodes[j]
+		if ei.numbered != ej.numbered {
+			return ei.numbered
+		}
+		if ei.number != ej.number {
+			return ei.number < ej.number
+		}
+		return ei.recordedItem.StartAt < ej.recordedItem.StartAt
+	})
+	for i := range episodes {
+		records[i] = episodes[i].recordedItem
+	}
+}
+
+// loadSeries lists series, the one recorded most recently first
+func loadSeries(ctx context.Context, container *Container) ([]interface{}, error) {
+	records, err := recorded(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var children []interface{}
+	byID := make(map[ObjectID]*Container)
+	for _, recordedItem := range records {
+		id := seriesID(recordedItem)
+		child, ok := byID[id]
+		if !ok {
+			child = newLazyContainer(id, container.Id, seriesTitle(recordedItem), loadEpisodes, 0)
+			child.subset = true
+			byID[id] = child
+			children = append(children, child)
+		}
+		child.countHint++
+	}
+	for _, child := range children {
+		child := child.(*Container)
+		child.Title = fmt.Sprintf("%s (%d)", child.Title, child.countHint)
+	}
+	return children, nil
+}
+
+func loadEpisodes(ctx context.Context, container *Container) ([]interface{}, error) {
+	records, err := recorded(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var episodes []*epgstation.RecordedItem
+	for _, recordedItem := range records {
+		if seriesID(recordedItem) == container.Id {
+			episodes = append(episodes, recordedItem)
+		}
+	}
+	sortEpisodes(episodes)
+	items := make([]interface{}, len(episodes))
+	for i, recordedItem := range episodes {
+		items[i] = NewItem(container.Id, recordedItem)
+	}
+	return items, nil
+}
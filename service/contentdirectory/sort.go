@@ -0,0 +1,161 @@
+package contentdirectory
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSortCriteria = errors.New("invalid sort criteria")
+
+// SortCapabilities is the list of properties which can be used in SortCriteria
+var SortCapabilities = []string{
+	"dc:title",
+	"dc:date",
+	"upnp:class",
+	"upnp:channelName",
+	"res@duration",
+	"res@size",
+}
+
+type sortKey struct {
+	property   string
+	descending bool
+}
+
+// parseSortCriteria parses SortCriteria like "+dc:date,-dc:title" described in ContentDirectory:1 section 2.5.7
+func parseSortCriteria(criteria string) ([]sortKey, error) {
+	var keys []sortKey
+	for _, field := range strings.Split(criteria, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key := sortKey{}
+		switch field[0] {
+		case '+':
+			field = field[1:]
+		case '-':
+			key.descending = true
+			field = field[1:]
+		}
+		supported := false
+		for _, p := range SortCapabilities {
+			if p == field {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return nil, fmt.Errorf("%w: unsupported property %s", ErrInvalidSortCriteria, field)
+		}
+		key.property = field
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// sortValue returns value to compare object by property, or nil when object
+// does not have the property. Values of a property are of the same type,
+// int64 for dc:date, res@duration and res@size, and string for others.
+func sortValue(object interface{}, property string) interface{} {
+	switch property {
+	case "dc:date":
+		item, ok := object.(*Item)
+		if !ok {
+			return nil
+		}
+		if item.recorded != nil {
+			// compare with time in milliseconds, as dc:date has seconds only
+			return int64(item.recorded.StartAt)
+		}
+		// items of live broadcasts
+		date, err := time.Parse(dateTimeFormat, item.Date)
+		if err != nil {
+			return nil
+		}
+		return date.UnixMilli()
+	case "res@duration", "res@size":
+		item, ok := object.(*Item)
+		if !ok || item.Resources == nil || len(*item.Resources) == 0 {
+			return nil
+		}
+		var max int64
+		for _, res := range *item.Resources {
+			v := int64(res.Size)
+			if property == "res@duration" {
+				v = int64(res.DurationNS / time.Millisecond)
+			}
+			if v > max {
+				max = v
+			}
+		}
+		return max
+	}
+	values := propertyValues(object, property)
+	if len(values) == 0 {
+		return nil
+	}
+	return strings.ToLower(values[0])
+}
+
+// compareSortValues orders objects without the property first
+func compareSortValues(a interface{}, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	switch a := a.(type) {
+	case int64:
+		b, ok := b.(int64)
+		switch {
+		case !ok:
+			// never happens, but ordered consistently anyway
+			return -1
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 1
+		}
+		return strings.Compare(a, b)
+	}
+	return 0
+}
+
+// sortObjects returns copy of objects sorted by criteria. Objects are kept in
+// the original order when criteria is empty or they are equal.
+func sortObjects(objects []interface{}, criteria string) ([]interface{}, error) {
+	keys, err := parseSortCriteria(criteria)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return objects, nil
+	}
+	sorted := make([]interface{}, len(objects))
+	copy(sorted, objects)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		for _, key := range keys {
+			c := compareSortValues(sortValue(sorted[i], key.property), sortValue(sorted[j], key.property))
+			if key.descending {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return sorted, nil
+}
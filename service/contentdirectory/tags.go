@@ -0,0 +1,72 @@
+package contentdirectory
+
+import (
+	"context"
+	"upnp-mediaserver/epgstation"
+)
+
+func tagContainerID(tagId epgstation.RecordedTagId) ObjectID {
+	return childID(tagsContainerID, int(tagId))
+}
+
+// hasTag reports whether recordedItem is tagged with tagId
+func hasTag(recordedItem *epgstation.RecordedItem, tagId epgstation.RecordedTagId) bool {
+	if recordedItem.Tags == nil {
+		return false
+	}
+	for _, tag := range *recordedItem.Tags {
+		if tag.Id == tagId {
+			return true
+		}
+	}
+	return false
+}
+
+// tagNames returns names of tags of recordedItem
+func tagNames(recordedItem *epgstation.RecordedItem) []string {
+	if recordedItem.Tags == nil {
+		return nil
+	}
+	names := make([]string, len(*recordedItem.Tags))
+	for i, tag := range *recordedItem.Tags {
+		names[i] = tag.Name
+	}
+	return names
+}
+
+func loadTags(ctx context.Context, container *Container) ([]interface{}, error) {
+	tags, err := epgstation.IterateTags(ctx, epgstation.GetTagsParams{}).All()
+	if err != nil {
+		return nil, err
+	}
+	records, err := recorded(ctx)
+	if err != nil {
+		return nil, err
+	}
+	children := make([]interface{}, 0, len(tags))
+	for _, tag := range tags {
+		tagId := tag.Id
+		count := 0
+		for _, recordedItem := range records {
+			if hasTag(recordedItem, tagId) {
+				count++
+			}
+		}
+		child := newLazyContainer(tagContainerID(tagId), container.Id, tag.Name, func(ctx context.Context, container *Container) ([]interface{}, error) {
+			records, err := recorded(ctx)
+			if err != nil {
+				return nil, err
+			}
+			var items []interface{}
+			for _, recordedItem := range records {
+				if hasTag(recordedItem, tagId) {
+					items = append(items, NewItem(container.Id, recordedItem))
+				}
+			}
+			return items, nil
+		}, count)
+		child.subset = true
+		children = append(children, child)
+	}
+	return children, nil
+}
@@ -0,0 +1,62 @@
+package contentdirectory
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+	"upnp-mediaserver/config"
+	"upnp-mediaserver/epgstation"
+)
+
+// Recorded TS files are offered also as transcoded by EPGStation on the fly,
+// for clients which can not play MPEG-2 TS with ARIB audio.
+
+var streamModes atomic.Value // []config.StreamMode
+
+func currentStreamModes() []config.StreamMode {
+	modes, _ := streamModes.Load().([]config.StreamMode)
+	return modes
+}
+
+// LookupStreamMode returns streaming setting of container and mode if offered
+func LookupStreamMode(container string, mode int) (config.StreamMode, bool) {
+	for _, m := range currentStreamModes() {
+		if m.Container == container && m.Mode == mode {
+			return m, true
+		}
+	}
+	return config.StreamMode{}, false
+}
+
+// formats of transcoded streams. DLNA profile is unknown as encoding options
+// are up to EPGStation, and bytes of the end are unknown, so seek by time only.
+var streamFormats = map[string]videoFormat{
+	"mp4":  {mime: "video/mp4", op: "10", ci: "1"},
+	"webm": {mime: "video/webm", op: "10", ci: "1"},
+}
+
+// StreamContentFeatures returns contentFeatures.dlna.org of streams of container
+func StreamContentFeatures(container string) string {
+	return streamFormats[container].contentFeatures(false)
+}
+
+// newStreamResources returns resources of videoFile transcoded in each
+// stream mode. Only TS files are transcoded by stream modes of EPGStation.
+func newStreamResources(videoFile *epgstation.VideoFile, duration time.Duration) []Res {
+	if videoFile.Type != epgstation.VideoFileTypeTs {
+		return nil
+	}
+	var resources []Res
+	for _, mode := range currentStreamModes() {
+		resources = append(resources, Res{
+			ProtocolInfo: streamFormats[mode.Container].protocolInfo(false),
+			URL:          fmt.Sprintf("%svideos/transcoded?videoFileId=%d&container=%s&mode=%d", serviceURLBase, videoFile.Id, mode.Container, mode.Mode),
+			Duration:     FormatDuration(duration),
+			DurationNS:   duration,
+			Resolution:   mode.Resolution,
+			videoFile:    *videoFile,
+			transcoded:   true,
+		})
+	}
+	return resources
+}
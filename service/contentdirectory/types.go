@@ -6,15 +6,12 @@ import (
 	"upnp-mediaserver/epgstation"
 	"log"
 	"path/filepath"
-	"strconv"
 	"time"
 )
 
 type ObjectID string
 
 var JST = time.FixedZone("Asia/Tokyo", 9*60*60)
-var registory = make(map[ObjectID]interface{})
-var resRegistory = make(map[ObjectID]interface{})
 
 type Container struct {
 	XMLName xml.Name `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ container"`
@@ -25,20 +22,31 @@ type Container struct {
 	Class      string   `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ class"`
 	Restricted string   `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ restricted,attr"`
 
-	ChildCount int           `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ childCount,attr"`
+	// set on serialization from len(Children), if requested by Filter
+	ChildCount *int          `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ childCount,attr,omitempty"`
 	Children   []interface{} `xml:"-"`
+
+	// resolves children on demand, nil for containers with fixed children
+	loader loader
+	// when children were resolved, zero if not yet or invalidated
+	loadedAt time.Time
+	// number of children known before resolving them, -1 if unknown
+	countHint int
+	// signature of children when resolved, to notice changes on next resolution
+	signature uint64
+	// children are items also in 録画済み, or not recordings like ライブ, so
+	// that Search can skip them
+	subset bool
 }
 
 func (c *Container) AppendContainer(child *Container) {
 	c.Children = append(c.Children, child)
-	c.ChildCount++
-	registory[child.Id] = child
+	registry.objects[child.Id] = child
 }
 
 func (c *Container) AppendItem(item *Item) {
 	c.Children = append(c.Children, item)
-	c.ChildCount++
-	registory[item.Id] = item
+	registry.register(item)
 }
 
 type Item struct {
@@ -49,27 +57,62 @@ type Item struct {
 	Title      string   `xml:"http://purl.org/dc/elements/1.1/ title"`
 	Class      string   `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ class"`
 	Restricted string   `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ restricted,attr"`
+	// ID of the same recording in 録画済み, for items in other containers
+	RefID *ObjectID `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ refID,attr,omitempty"`
+
+	Date               string   `xml:"http://purl.org/dc/elements/1.1/ date,omitempty"`
+	Description        *string  `xml:"http://purl.org/dc/elements/1.1/ description,omitempty"`
+	LongDescription    *string  `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ longDescription,omitempty"`
+	Genres             []string `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ genre,omitempty"`
+	ChannelName        *string  `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ channelName,omitempty"`
+	ChannelNr          *int     `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ channelNr,omitempty"`
+	ScheduledStartTime string   `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ scheduledStartTime,omitempty"`
+	ScheduledEndTime   string   `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ scheduledEndTime,omitempty"`
+	Resources          *[]Res
 
-	Date      string `xml:"http://purl.org/dc/elements/1.1/ date"`
-	Resources *[]Res
+	AlbumArtURI *AlbumArtURI
 
-	AlbumArtURI *string `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ albumArtURI"`
+	// source of properties not serialized, like ones used in Search
+	recorded *epgstation.RecordedItem
 }
 
 type Res struct {
 	XMLName      xml.Name      `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ res"`
 	ProtocolInfo string        `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ protocolInfo,attr"`
-	Size         int           `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ size,attr"`
-	Duration     string        `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ duration,attr"`
+	Size         int           `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ size,attr,omitempty"`
+	Duration     string        `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ duration,attr,omitempty"`
 	DurationNS   time.Duration `xml:"-"`
-	URL          string        `xml:",chardata"`
+	// bytes per second
+	Bitrate         int    `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ bitrate,attr,omitempty"`
+	Resolution      string `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ resolution,attr,omitempty"`
+	NrAudioChannels int    `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ nrAudioChannels,attr,omitempty"`
+	SampleFrequency int    `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ sampleFrequency,attr,omitempty"`
+	URL             string `xml:",chardata"`
+
+	videoFile epgstation.VideoFile
+	recording bool
+	// transcoded by EPGStation on the fly, not the video file as is
+	transcoded bool
+	// resized thumbnail, not a video file
+	thumbnail bool
+	// live broadcast, not a video file
+	live bool
+}
+
+type AlbumArtURI struct {
+	XMLName xml.Name `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ albumArtURI"`
+	// prefixed literally, as some clients look for dlna:profileID by name
+	ProfileID string `xml:"dlna:profileID,attr,omitempty"`
+	URL       string `xml:",chardata"`
 }
 
 // <DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">
 
 type DIDLLite struct {
 	XMLName xml.Name `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ DIDL-Lite"`
-	Objects []interface{}
+	// declares prefix of dlna:profileID
+	DLNANamespace string `xml:"xmlns:dlna,attr"`
+	Objects       []interface{}
 }
 
 func NewContainer(Id ObjectID, Parent *Container, Title string) *Container {
@@ -87,41 +130,212 @@ func NewContainer(Id ObjectID, Parent *Container, Title string) *Container {
 		Class:      "object.container",
 		Restricted: "true",
 		Children:   make([]interface{}, 0),
-		ChildCount: 0,
 	}
-	registory[container.Id] = container
+	registry.objects[container.Id] = container
 	if Parent != nil {
 		Parent.AppendContainer(container)
 	}
 	return container
 }
 
-func fmtProtocolInfo(videoFile *epgstation.VideoFile) (string, error) {
-	var mime, pn, op, ci string
-
-	switch filepath.Ext(*videoFile.Filename) {
-	case ".m2ts":
-		mime = "video/mpeg"
-		pn = "MPEG_PS_NTSC"
-		op = "10"
-		ci = "0"
-	case ".mp4":
-		mime = "video/mp4"
-		pn = "AVC_MP4_BL_CIF15_AAC_520"
-		op = "01"
-		ci = "1"
-	case ".mkv":
-		mime = "video/x-matroska"
-		pn = "AVC_MKV_HP_HD_AAC_MULT5"
-		op = "01"
-		ci = "1"
-	default:
-		return "", fmt.Errorf("unknown filetype %s", filepath.Ext(*videoFile.Filename))
+// newLazyContainer returns container of Id under ParentID, whose children are
+// resolved by load on demand. It is registered when its parent resolves
+// children. countHint is the number of children if known beforehand, or -1.
+func newLazyContainer(Id ObjectID, ParentID ObjectID, Title string, load loader, countHint int) *Container {
+	return &Container{
+		Id:         Id,
+		ParentID:   ParentID,
+		Title:      Title,
+		Class:      "object.container",
+		Restricted: "true",
+		loader:     load,
+		countHint:  countHint,
+	}
+}
+
+type videoFormat struct {
+	ext  string
+	mime string
+	pn   string
+	op   string
+	ci   string
+	// DLNA.ORG_FLAGS, dlnaFlags if empty
+	flags string
+}
+
+var videoFormats = []videoFormat{
+	{ext: ".m2ts", mime: "video/mpeg", pn: "MPEG_PS_NTSC", op: "10", ci: "0"},
+	{ext: ".mp4", mime: "video/mp4", pn: "AVC_MP4_BL_CIF15_AAC_520", op: "01", ci: "1"},
+	{ext: ".mkv", mime: "video/x-matroska", pn: "AVC_MKV_HP_HD_AAC_MULT5", op: "01", ci: "1"},
+}
+
+// DLNA.ORG_FLAGS of resources. Resources being recorded grow while playing,
+// so sn-increasing and lop-npt (seek only within recorded part) are added.
+const (
+	dlnaFlags          = "01118000000000000000000000000000"
+	dlnaFlagsRecording = "45118000000000000000000000000000"
+)
+
+// contentFeatures returns the fourth field of protocolInfo, also used as
+// contentFeatures.dlna.org. DLNA.ORG_PN is omitted if the profile is unknown.
+func (f videoFormat) contentFeatures(recording bool) string {
+	op, flags := f.op, dlnaFlags
+	if f.flags != "" {
+		flags = f.flags
+	}
+	if recording {
+		// bytes of the end are unknown, seek by time only
+		op, flags = "10", dlnaFlagsRecording
+	}
+	pn := ""
+	if f.pn != "" {
+		pn = fmt.Sprintf("DLNA_ORG.PN=%s;", f.pn)
 	}
-	return fmt.Sprintf("http-get:*:%s:DLNA_ORG.PN=%s;DLNA.ORG_OP=%s;DLNA.ORG_CI=%s;DLNA.ORG_FLAGS=01118000000000000000000000000000", mime, pn, op, ci), nil
+	return fmt.Sprintf("%sDLNA.ORG_OP=%s;DLNA.ORG_CI=%s;DLNA.ORG_FLAGS=%s", pn, op, f.ci, flags)
 }
 
-func fmtDuration(d time.Duration) string {
+func (f videoFormat) protocolInfo(recording bool) string {
+	return fmt.Sprintf("http-get:*:%s:%s", f.mime, f.contentFeatures(recording))
+}
+
+func fmtProtocolInfo(videoFile *epgstation.VideoFile, recording bool) (string, error) {
+	ext := filepath.Ext(*videoFile.Filename)
+	for _, f := range videoFormats {
+		if f.ext == ext {
+			return f.protocolInfo(recording), nil
+		}
+	}
+	return "", fmt.Errorf("unknown filetype %s", ext)
+}
+
+// A ThumbnailProfile is a DLNA image profile which thumbnails are resized to fit in
+type ThumbnailProfile struct {
+	ID        string
+	MaxWidth  int
+	MaxHeight int
+}
+
+// ThumbnailProfiles are profiles thumbnails are served in, the smallest first
+var ThumbnailProfiles = []ThumbnailProfile{
+	{ID: "JPEG_TN", MaxWidth: 160, MaxHeight: 160},
+	{ID: "JPEG_SM", MaxWidth: 640, MaxHeight: 480},
+}
+
+// LookupThumbnailProfile returns profile of id, like JPEG_TN
+func LookupThumbnailProfile(id string) (ThumbnailProfile, bool) {
+	for _, profile := range ThumbnailProfiles {
+		if profile.ID == id {
+			return profile, true
+		}
+	}
+	return ThumbnailProfile{}, false
+}
+
+// DLNA.ORG_FLAGS of thumbnails, interactive and background transfer
+const dlnaFlagsImage = "00D00000000000000000000000000000"
+
+// ContentFeatures returns contentFeatures.dlna.org of thumbnails resized to p
+func (p ThumbnailProfile) ContentFeatures() string {
+	return fmt.Sprintf("DLNA.ORG_PN=%s;DLNA.ORG_CI=1;DLNA.ORG_FLAGS=%s", p.ID, dlnaFlagsImage)
+}
+
+func (p ThumbnailProfile) protocolInfo() string {
+	return "http-get:*:image/jpeg:" + p.ContentFeatures()
+}
+
+// thumbnailURL returns URL of thumbnail of EPGStation resized to p by this server
+func (p ThumbnailProfile) thumbnailURL(thumbnailId epgstation.ThumbnailId) string {
+	return fmt.Sprintf("%sthumbnails/%d?profile=%s", serviceURLBase, thumbnailId, p.ID)
+}
+
+// SourceProtocolInfos returns every protocolInfo which resources of this server may have
+func SourceProtocolInfos() []string {
+	var protocolInfos []string
+	for _, f := range videoFormats {
+		protocolInfos = append(protocolInfos, f.protocolInfo(false), f.protocolInfo(true))
+	}
+	for _, container := range []string{"mp4", "webm"} {
+		protocolInfos = append(protocolInfos, streamFormats[container].protocolInfo(false))
+	}
+	for _, container := range []string{"m2ts", "mp4", "webm"} {
+		protocolInfos = append(protocolInfos, liveFormats[container].protocolInfo(false))
+	}
+	for _, p := range ThumbnailProfiles {
+		protocolInfos = append(protocolInfos, p.protocolInfo())
+	}
+	return protocolInfos
+}
+
+// resolutions of videoResolution of EPGStation
+var videoResolutions = map[epgstation.ProgramVideoResolution]string{
+	"240p":  "320x240",
+	"480i":  "720x480",
+	"480p":  "720x480",
+	"720p":  "1280x720",
+	"1080i": "1920x1080",
+	"1080p": "1920x1080",
+	"2160p": "3840x2160",
+	"4320p": "7680x4320",
+}
+
+// number of audio channels of audio component_type of ARIB STD-B10, like 3
+// for stereo (2/0 mode)
+var audioChannels = map[int]int{
+	0x01: 1, // 1/0 mode (mono)
+	0x02: 2, // 1/0 + 1/0 mode (dual mono)
+	0x03: 2, // 2/0 mode (stereo)
+	0x04: 3, // 2/1 mode
+	0x05: 3, // 3/0 mode
+	0x06: 4, // 2/2 mode
+	0x07: 4, // 3/1 mode
+	0x08: 5, // 3/2 mode
+	0x09: 6, // 3/2 + LFE mode (5.1ch)
+}
+
+// setMediaInfo sets properties of res known from recordedItem. Properties of
+// encoded videos may differ from broadcast, but are close enough for clients
+// to choose.
+func setMediaInfo(res *Res, recordedItem *epgstation.RecordedItem) {
+	if recordedItem.VideoResolution != nil {
+		res.Resolution = videoResolutions[*recordedItem.VideoResolution]
+	}
+	if recordedItem.AudioComponentType != nil {
+		res.NrAudioChannels = audioChannels[*recordedItem.AudioComponentType]
+	}
+	if recordedItem.AudioSamplingRate != nil {
+		res.SampleFrequency = int(*recordedItem.AudioSamplingRate)
+	}
+	if res.Size > 0 && res.DurationNS >= time.Second {
+		res.Bitrate = int(int64(res.Size) * int64(time.Second) / int64(res.DurationNS))
+	}
+}
+
+// startTime returns start of recordedItem in the time zone of dates
+func startTime(recordedItem *epgstation.RecordedItem) time.Time {
+	return time.UnixMilli(int64(recordedItem.StartAt)).In(currentLocation())
+}
+
+// format of dc:date and upnp:scheduledStartTime, xsd:dateTime without fraction
+const dateTimeFormat = "2006-01-02T15:04:05-07:00"
+
+// genreNames returns names of genres and subgenres of recordedItem, followed
+// by tags given by family members, like genres by themselves
+func genreNames(recordedItem *epgstation.RecordedItem) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, pair := range genresOf(recordedItem) {
+		for _, name := range []string{genreIdNameMap[pair.genre], subGenreName(pair)} {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return append(names, tagNames(recordedItem)...)
+}
+
+// FormatDuration formats d as res@duration and npt of TimeSeekRange.dlna.org
+func FormatDuration(d time.Duration) string {
 	h := d / time.Hour
 	d -= h * time.Hour
 	m := d / time.Minute
@@ -133,50 +347,109 @@ func fmtDuration(d time.Duration) string {
 	return fmt.Sprintf("%d:%02d:%02d.%03d", h, m, s, ms)
 }
 
-func NewResource(videoFile *epgstation.VideoFile, duration time.Duration) Res {
-	protocolInfo, err := fmtProtocolInfo(videoFile)
+func NewResource(videoFile *epgstation.VideoFile, duration time.Duration) (Res, error) {
+	protocolInfo, err := fmtProtocolInfo(videoFile, false)
 	if err != nil {
-		log.Fatal(err)
+		return Res{}, err
 	}
-	res := Res{
+	return Res{
 		ProtocolInfo: protocolInfo,
 		URL:          fmt.Sprintf("%svideos/recorded?videoFileId=%d", serviceURLBase, videoFile.Id),
 		Size:         videoFile.Size,
-		Duration:     fmtDuration(duration),
+		Duration:     FormatDuration(duration),
 		DurationNS:   duration,
-	}
-	objectId := strconv.Itoa(int(videoFile.Id))
-	resRegistory[ObjectID(objectId)] = &res
-	return res
+		videoFile:    *videoFile,
+	}, nil
 }
 
-func NewItem(Parent *Container, recordedItem *epgstation.RecordedItem, videoFileIdDurationMap map[epgstation.VideoFileId]time.Duration) *Item {
-	if Parent == nil {
-		log.Fatal("container is required for item")
+// newRecordingResource returns resource of videoFile being recorded, whose
+// size and duration are unknown until recording finishes
+func newRecordingResource(videoFile *epgstation.VideoFile) (Res, error) {
+	protocolInfo, err := fmtProtocolInfo(videoFile, true)
+	if err != nil {
+		return Res{}, err
 	}
+	return Res{
+		ProtocolInfo: protocolInfo,
+		URL:          fmt.Sprintf("%svideos/recorded?videoFileId=%d", serviceURLBase, videoFile.Id),
+		videoFile:    *videoFile,
+		recording:    true,
+	}, nil
+}
+
+// NewItem returns item of recordedItem to be a child of container ParentID.
+// It is registered when its parent resolves children.
+func NewItem(ParentID ObjectID, recordedItem *epgstation.RecordedItem) *Item {
+	// copy, as recordedItem may point to loop variable of caller
+	recorded := *recordedItem
 
-	resources := make([]Res, len(*recordedItem.VideoFiles))
-	for i, videoFile := range *recordedItem.VideoFiles {
-		// Some videoFile may deleted from filesystem manually. In such case, mapping entry not found 
-		if duration, ok := videoFileIdDurationMap[videoFile.Id]; ok {
-			resources[i] = NewResource(&videoFile, duration)
+	// duration of program, which may differ from actual video by a few seconds.
+	// asking EPGStation for every video file is too slow to browse containers.
+	duration := time.Duration(recordedItem.EndAt-recordedItem.StartAt) * time.Millisecond
+	// recordings in progress may have no files yet
+	var videoFiles []epgstation.VideoFile
+	if recordedItem.VideoFiles != nil {
+		videoFiles = *recordedItem.VideoFiles
+	}
+	resources := make([]Res, 0, len(videoFiles))
+	for _, videoFile := range videoFiles {
+		res, err := NewResource(&videoFile, duration)
+		if recordedItem.IsRecording {
+			res, err = newRecordingResource(&videoFile)
+		}
+		if err != nil {
+			log.Printf("recorded %d: %s", recordedItem.Id, err)
+			continue
+		}
+		setMediaInfo(&res, recordedItem)
+		resources = append(resources, res)
+		if !recordedItem.IsRecording {
+			resources = append(resources, newStreamResources(&videoFile, duration)...)
 		}
 	}
 	item := &Item{
-		Id:         ObjectID(strconv.Itoa(int(recordedItem.Id))),
-		ParentID:   Parent.Id,
+		Id:         childID(ParentID, recordedItem.Id),
+		ParentID:   ParentID,
 		Title:      recordedItem.Name,
 		Class:      "object.item.videoItem",
 		Restricted: "true",
 
 		Resources: &resources,
 
-		Date: time.Unix(int64(recordedItem.StartAt)/1000, 0).In(JST).Format("2006-01-02"),
+		Date:               startTime(recordedItem).Format(dateTimeFormat),
+		Description:        recordedItem.Description,
+		LongDescription:    recordedItem.Extended,
+		Genres:             genreNames(recordedItem),
+		ScheduledStartTime: startTime(recordedItem).Format(dateTimeFormat),
+		ScheduledEndTime:   time.UnixMilli(int64(recordedItem.EndAt)).In(currentLocation()).Format(dateTimeFormat),
+
+		recorded: &recorded,
+	}
+	// recordings in progress are not in 録画済み yet
+	if ParentID != recordedContainerID && !recordedItem.IsRecording {
+		refID := childID(recordedContainerID, recordedItem.Id)
+		item.RefID = &refID
 	}
-	if len(*recordedItem.Thumbnails) > 0 {
-		albumArtURI := fmt.Sprintf("%s/thumbnails/%d", epgstation.ServerAPIRoot, (*recordedItem.Thumbnails)[0])
-		item.AlbumArtURI = &albumArtURI
+	if recordedItem.ChannelId != nil {
+		if channel, ok := channelItem(*recordedItem.ChannelId); ok {
+			channelNr := int(channel.ServiceId)
+			item.ChannelName, item.ChannelNr = &channel.HalfWidthName, &channelNr
+		}
+	}
+	if recordedItem.Thumbnails != nil && len(*recordedItem.Thumbnails) > 0 {
+		// served by this server, as clients may not reach EPGStation
+		thumbnailId := (*recordedItem.Thumbnails)[0]
+		item.AlbumArtURI = &AlbumArtURI{
+			ProfileID: ThumbnailProfiles[0].ID,
+			URL:       ThumbnailProfiles[0].thumbnailURL(thumbnailId),
+		}
+		for _, profile := range ThumbnailProfiles {
+			resources = append(resources, Res{
+				ProtocolInfo: profile.protocolInfo(),
+				URL:          profile.thumbnailURL(thumbnailId),
+				thumbnail:    true,
+			})
+		}
 	}
-	Parent.AppendItem(item)
 	return item
 }
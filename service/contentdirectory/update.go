@@ -0,0 +1,70 @@
+package contentdirectory
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var updateMu sync.Mutex
+
+// SystemUpdateID starts from current unix time, so that it keeps increasing
+// across restarts as long as it changes less than once a second in average.
+var systemUpdateID = int(uint32(time.Now().Unix()))
+var updateNotifier func(systemUpdateID int, containerUpdateIDs string)
+
+// OnUpdate registers fn to be called when content tree changes, with the new
+// SystemUpdateID and ContainerUpdateIDs (pairs of changed container id and its update id)
+func OnUpdate(fn func(systemUpdateID int, containerUpdateIDs string)) {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	updateNotifier = fn
+}
+
+func SystemUpdateID() int {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	return systemUpdateID
+}
+
+func containerSignature(container *Container) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00", container.Title)
+	for _, child := range container.Children {
+		switch child := child.(type) {
+		case *Container:
+			fmt.Fprintf(h, "%s\x00%s\x00", child.Id, child.Title)
+		case *Item:
+			fmt.Fprintf(h, "%s\x00%s\x00%d\x00", child.Id, child.Title, len(*child.Resources))
+			for _, res := range *child.Resources {
+				fmt.Fprintf(h, "%s\x00%d\x00", res.URL, res.Size)
+			}
+		}
+	}
+	return h.Sum64()
+}
+
+// notifyUpdated bumps SystemUpdateID, then notifies containers of ids
+// updated with it
+func notifyUpdated(ids ...ObjectID) {
+	updateMu.Lock()
+	systemUpdateID++
+	changed := make([]string, len(ids))
+	for i, id := range ids {
+		changed[i] = string(id)
+	}
+	sort.Strings(changed)
+	pairs := make([]string, 0, len(changed)*2)
+	for _, id := range changed {
+		pairs = append(pairs, id, fmt.Sprint(systemUpdateID))
+	}
+	notifier, current := updateNotifier, systemUpdateID
+	updateMu.Unlock()
+
+	if notifier != nil {
+		notifier(current, strings.Join(pairs, ","))
+	}
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"upnp-mediaserver/epgstation"
+	"upnp-mediaserver/service/contentdirectory"
+)
+
+// startLiveStream asks EPGStation to stream live broadcast of channelId in
+// container and mode, and returns the response streaming it
+func startLiveStream(ctx context.Context, channelId epgstation.ChannelId, container string, mode int) (*http.Response, error) {
+	id := epgstation.PathChannelId(channelId)
+	switch container {
+	case "m2ts":
+		return epgstation.EPGStation().GetStreamsLiveChannelIdM2ts(ctx, id, &epgstation.GetStreamsLiveChannelIdM2tsParams{
+			Mode: epgstation.StreamMode(mode),
+		})
+	case "mp4":
+		return epgstation.EPGStation().GetStreamsLiveChannelIdMp4(ctx, id, &epgstation.GetStreamsLiveChannelIdMp4Params{
+			Mode: epgstation.StreamMode(mode),
+		})
+	case "webm":
+		return epgstation.EPGStation().GetStreamsLiveChannelIdWebm(ctx, id, &epgstation.GetStreamsLiveChannelIdWebmParams{
+			Mode: epgstation.StreamMode(mode),
+		})
+	}
+	return nil, fmt.Errorf("unsupported container %s", container)
+}
+
+// liveStreamHandler streams live broadcast of a channel in the live stream
+// mode. Live broadcasts can not be seeked.
+func liveStreamHandler(w http.ResponseWriter, r *http.Request) {
+	channelId, err := strconv.Atoi(r.URL.Query().Get("channelId"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	channelItem, ok := contentdirectory.LookupChannel(r.Context(), epgstation.ChannelId(channelId))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	mode := contentdirectory.LiveStream()
+	log.Printf("channelId: %d, %s mode %d", channelId, mode.Container, mode.Mode)
+
+	w.Header().Set("transferMode.dlna.org", "Streaming")
+	w.Header().Set("contentFeatures.dlna.org", contentdirectory.LiveContentFeatures())
+	contentType := "video/" + mode.Container
+	if mode.Container == "m2ts" {
+		contentType = "video/mpeg"
+	}
+	if r.Method == http.MethodHead {
+		// clients often ask headers before playing, not worth tuning
+		w.Header().Set("Content-Type", contentType)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	match := func(item epgstation.StreamInfoItem) bool {
+		return item.VideoFileId == nil && item.ChannelId == channelItem.Id && int(item.Mode) == mode.Mode
+	}
+	key := fmt.Sprintf("live/%d/%d", channelItem.Id, mode.Mode)
+	res, err := startKeptStream(ctx, key, match, func() (*http.Response, error) {
+		return startLiveStream(ctx, channelItem.Id, mode.Container, mode.Mode)
+	})
+	if err != nil {
+		log.Print(err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		log.Printf("live stream of channel %d: %s", channelItem.Id, res.Status)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, res.Body)
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"upnp-mediaserver/epgstation"
+	"upnp-mediaserver/service/contentdirectory"
+)
+
+// interval to ask EPGStation for the rest of a video file being recorded
+const recordingPollInterval = 2 * time.Second
+
+// headers of EPGStation not relayed for a video file being recorded, as its
+// length is unknown
+var recordingSkippedHeaders = map[string]bool{
+	"Content-Length": true,
+	"Content-Range":  true,
+	"Accept-Ranges":  true,
+}
+
+// fetchVideo requests video file from offset to EPGStation
+func fetchVideo(ctx context.Context, videoFileId epgstation.VideoFileId, offset int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/videos/%d", epgstation.ServerAPIRoot(), videoFileId), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// recordingVideoStreamHandler streams a video file being recorded with
+// chunked transfer, following the file as it grows until recording finishes.
+// Time seek is limited to the part already recorded.
+func recordingVideoStreamHandler(w http.ResponseWriter, r *http.Request, resource *contentdirectory.Resource) {
+	ctx := r.Context()
+	var offset int64
+	if timeSeekReqHeader := r.Header.Get("Timeseekrange.dlna.org"); timeSeekReqHeader != "" {
+		log.Printf("Timeseekrange.dlna.org: %s", timeSeekReqHeader)
+		startDuration, startStr := parseTimeSeekHeader(timeSeekReqHeader)
+		duration, size, _, err := resource.Progress(ctx)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		if startDuration >= duration {
+			// not recorded yet
+			http.Error(w, http.StatusText(http.StatusRequestedRangeNotSatisfiable), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		offset = int64(float64(startDuration) / float64(duration) * float64(size))
+		w.Header().Set("Timeseekrange.dlna.org", fmt.Sprintf("npt=%s-%s/*", startStr, contentdirectory.FormatDuration(duration)))
+	}
+
+	wroteHeader, finished := false, false
+	for {
+		res, err := fetchVideo(ctx, resource.VideoFile.Id, offset)
+		if err != nil {
+			if !wroteHeader {
+				log.Print(err)
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			}
+			return
+		}
+		if !wroteHeader {
+			if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+				res.Body.Close()
+				log.Printf("video %d: %s", resource.VideoFile.Id, res.Status)
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+				return
+			}
+			for k, vs := range res.Header {
+				if recordingSkippedHeaders[k] {
+					continue
+				}
+				if k == "Content-Type" && vs[0] == "video/mp2t" {
+					vs[0] = "video/mpeg"
+				}
+				w.Header().Set(k, vs[0])
+			}
+			w.Header().Set("Transfermode.dlna.org", "Streaming")
+			w.WriteHeader(http.StatusOK)
+			wroteHeader = true
+		} else if res.StatusCode == http.StatusOK && offset > 0 {
+			// range not supported, can not resume
+			res.Body.Close()
+			return
+		}
+
+		var n int64
+		if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusPartialContent {
+			n, err = io.Copy(w, res.Body)
+		}
+		res.Body.Close()
+		offset += n
+		if err != nil {
+			// client went away, or EPGStation failed
+			return
+		}
+		if n > 0 {
+			continue
+		}
+		if finished {
+			return
+		}
+		_, _, recording, err := resource.Progress(ctx)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		if !recording {
+			// ask once more for the end written after the last request
+			finished = true
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(recordingPollInterval):
+		}
+	}
+}
@@ -1,19 +1,26 @@
 package service
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 
 	"upnp-mediaserver/bufferpool"
+	"upnp-mediaserver/config"
 	"upnp-mediaserver/epgstation"
+	"upnp-mediaserver/gena"
 	"upnp-mediaserver/service/contentdirectory"
 	"upnp-mediaserver/soap"
 
@@ -22,38 +29,47 @@ import (
 
 var URLBase string
 
-func serveXMLFileHandler(tmplFile string, vars map[string]interface{}) http.HandlerFunc {
+// serveXMLFileHandler serves tmplFile as is, or executed as a template with
+// the result of vars for each request when vars is not nil.
+func serveXMLFileHandler(tmplFile string, vars func() map[string]interface{}) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/xml")
-		if len(vars) == 0 {
+		if vars == nil {
 			r, err := os.Open(tmplFile)
 			if err != nil {
-				log.Fatal("error on open file: ", err)
+				log.Print("error on open file: ", err)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
 			}
+			defer r.Close()
 			fi, err := r.Stat()
 			if err != nil {
-				log.Fatal("error on stat file: ", err)
+				log.Print("error on stat file: ", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
 			}
 			w.Header().Set("Content-Length", strconv.Itoa(int(fi.Size())))
 			io.Copy(w, r)
 		} else {
 			buf := bufferpool.NewBytesBuffer()
 			defer bufferpool.PutBytesBuffer(buf)
-			template.Must(template.ParseFiles(tmplFile)).Execute(buf, vars)
+			template.Must(template.ParseFiles(tmplFile)).Execute(buf, vars())
 			w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
 			w.Write(buf.Bytes())
 		}
 	}
 }
 
-func serviceContentDirectoryControlHandler(w http.ResponseWriter, r *http.Request) {
+func serviceControlHandler(w http.ResponseWriter, r *http.Request) {
+	res, statusCode := soap.HandleAction(r)
 	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
 	w.Header().Set("Server", "Linux/i686 UPnP/1.0 go-upnp-playground/0.0.1")
 	buf := bufferpool.NewBytesBuffer()
 	defer bufferpool.PutBytesBuffer(buf)
 	buf.WriteString(xml.Header)
-	buf.Write(soap.HandleAction(r))
+	buf.Write(res)
 	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(statusCode)
 	w.Write(buf.Bytes())
 }
 
@@ -66,11 +82,31 @@ func parseTimeSeekHeader(header string) (time.Duration, string) {
 }
 
 func recordedVideoStreamHandler(w http.ResponseWriter, r *http.Request) {
-	videoFileId := r.URL.Query().Get("videoFileId")
-       	log.Printf("videoFileId: %s", videoFileId)
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/videos/%s", epgstation.ServerAPIRoot, videoFileId), nil)
+	videoFileId, err := strconv.Atoi(r.URL.Query().Get("videoFileId"))
 	if err != nil {
-		log.Fatal(err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	log.Printf("videoFileId: %d", videoFileId)
+	resource, err := contentdirectory.LookupResource(r.Context(), epgstation.VideoFileId(videoFileId))
+	if errors.Is(err, contentdirectory.ErrNoSuchResource) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	if resource.Recording {
+		recordingVideoStreamHandler(w, r, resource)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), "GET", fmt.Sprintf("%s/videos/%d", epgstation.ServerAPIRoot(), resource.VideoFile.Id), nil)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
 	}
 	for k, vs := range r.Header {
 		req.Header.Set(k, vs[0])
@@ -79,16 +115,22 @@ func recordedVideoStreamHandler(w http.ResponseWriter, r *http.Request) {
 	if timeSeekReqHeader != "" {
         	log.Printf("Timeseekrange.dlna.org: %s", timeSeekReqHeader)
 		startDuration, startStr := parseTimeSeekHeader(timeSeekReqHeader)
-		resource := contentdirectory.GetResourceObject(videoFileId).(*contentdirectory.Res)
-		elapsedRatio := float64(startDuration) / float64(resource.DurationNS)
+		if startDuration >= resource.Duration {
+			http.Error(w, http.StatusText(http.StatusRequestedRangeNotSatisfiable), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		elapsedRatio := float64(startDuration) / float64(resource.Duration)
 		startByte := int(elapsedRatio * float64(resource.Size))
 		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", startByte, resource.Size-1))
-		w.Header().Set("Timeseekrange.dlna.org", fmt.Sprintf("npt=%s-%s/%s", startStr, resource.Duration, resource.Duration))
+		duration := contentdirectory.FormatDuration(resource.Duration)
+		w.Header().Set("Timeseekrange.dlna.org", fmt.Sprintf("npt=%s-%s/%s", startStr, duration, duration))
 	}
 	client := new(http.Client)
 	res, err := client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
 	}
 	defer res.Body.Close()
 	for k, vs := range res.Header {
@@ -101,11 +143,7 @@ func recordedVideoStreamHandler(w http.ResponseWriter, r *http.Request) {
         if res.ContentLength > 0 {
 		io.CopyN(w, res.Body, res.ContentLength)
 	} else {
-		for {
-			if _, err := io.Copy(w, res.Body); err != nil {
-				break
-			}
-		}
+		io.Copy(w, res.Body)
 	}
 }
 
@@ -114,14 +152,21 @@ type Server struct {
 	deviceUUID uuid.UUID
 	hostIP     net.IP
 	listener   *net.TCPListener
+	httpServer *http.Server
+
+	mu     sync.RWMutex // guards config, which is replaced on Reload
+	config *config.Config
+
+	contentDirectoryEvents  *gena.Publisher
+	connectionManagerEvents *gena.Publisher
 }
 
 func (s *Server) Listen() {
 	var err error
 	s.listener, err = net.ListenTCP("tcp", &net.TCPAddr{
 		IP:   s.hostIP,
-		Port: 0,
-	}) // start listen arbitorary port
+		Port: s.config.ListenPort,
+	}) // port 0 means start listen arbitorary port
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -130,33 +175,110 @@ func (s *Server) Listen() {
 }
 
 func (s *Server) Setup() {
-	epgstation.Setup(net.TCPAddr{
-		IP:   s.hostIP,
-		Port: 8888,
+	epgstation.Setup(s.config.EPGStationURLFor(s.hostIP))
+
+	s.contentDirectoryEvents = gena.NewPublisher(func() []gena.Property {
+		return []gena.Property{
+			{Name: "SystemUpdateID", Value: strconv.Itoa(contentdirectory.SystemUpdateID())},
+			{Name: "ContainerUpdateIDs", Value: ""},
+		}
+	})
+	s.connectionManagerEvents = gena.NewPublisher(func() []gena.Property {
+		return []gena.Property{
+			{Name: "SourceProtocolInfo", Value: strings.Join(contentdirectory.SourceProtocolInfos(), ",")},
+			{Name: "SinkProtocolInfo", Value: ""},
+			{Name: "CurrentConnectionIDs", Value: "0"},
+		}
 	})
+	contentdirectory.OnUpdate(func(systemUpdateID int, containerUpdateIDs string) {
+		s.contentDirectoryEvents.Notify(
+			gena.Property{Name: "SystemUpdateID", Value: strconv.Itoa(systemUpdateID)},
+			gena.Property{Name: "ContainerUpdateIDs", Value: containerUpdateIDs},
+		)
+	})
+	contentdirectory.Configure(s.config)
 	contentdirectory.Setup(URLBase)
 
-	http.HandleFunc("/", serveXMLFileHandler("tmpl/device.xml", map[string]interface{}{
-		"uuid":    s.deviceUUID,
-		"URLBase": URLBase,
+	http.HandleFunc("/", serveXMLFileHandler("tmpl/device.xml", func() map[string]interface{} {
+		return map[string]interface{}{
+			"uuid":         s.deviceUUID,
+			"URLBase":      URLBase,
+			"friendlyName": s.currentConfig().FriendlyName,
+		}
 	}))
 	http.HandleFunc("/ContentDirectory/scpd.xml", serveXMLFileHandler("file/ContentDirectory1.xml", nil))
 	http.HandleFunc("/ConnectionManager/scpd.xml", serveXMLFileHandler("file/ConnectionManager1.xml", nil))
 
-	http.HandleFunc("/ContentDirectory/control.xml", serviceContentDirectoryControlHandler)
-	http.HandleFunc("/ConnectionManager/control.xml", serviceContentDirectoryControlHandler)
+	http.HandleFunc("/ContentDirectory/control.xml", serviceControlHandler)
+	http.HandleFunc("/ConnectionManager/control.xml", serviceControlHandler)
+
+	http.Handle("/ContentDirectory/event.xml", s.contentDirectoryEvents)
+	http.Handle("/ConnectionManager/event.xml", s.connectionManagerEvents)
 
 	http.HandleFunc("/videos/recorded", recordedVideoStreamHandler)
+	http.HandleFunc("/videos/transcoded", transcodedVideoStreamHandler)
+	http.HandleFunc("/videos/live", liveStreamHandler)
+	http.HandleFunc("/thumbnails/", thumbnailHandler(filepath.Join(s.config.DataDir, "thumbnails")))
 }
 
+// Serve accepts connections until Shutdown. It returns http.ErrServerClosed
+// after Shutdown.
 func (s *Server) Serve() error {
-	return http.Serve(s.listener, nil)
+	return s.httpServer.Serve(s.listener)
+}
+
+// Watch keeps the content tree in sync with EPGStation until ctx is done.
+func (s *Server) Watch(ctx context.Context) {
+	contentdirectory.Watch(ctx)
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests to
+// finish until ctx is done, then closes remaining connections like video
+// streams forcibly. Event subscriptions are dropped as well.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		s.httpServer.Close()
+	}
+	if s.contentDirectoryEvents != nil {
+		s.contentDirectoryEvents.Close()
+	}
+	if s.connectionManagerEvents != nil {
+		s.connectionManagerEvents.Close()
+	}
+	return err
+}
+
+// Reload applies cfg to the running server and rebuilds the content tree.
+// Listen address and port, SSDP max-age, data directory and device UUID are
+// fixed at startup, so changes of them take effect only after restart.
+func (s *Server) Reload(cfg *config.Config) {
+	old := s.currentConfig()
+	if cfg.ListenAddress != old.ListenAddress || cfg.ListenPort != old.ListenPort ||
+		cfg.SSDPMaxAge != old.SSDPMaxAge || cfg.DataDir != old.DataDir || cfg.DeviceUUID != old.DeviceUUID {
+		log.Println("Reload: changes of listen_address, listen_port, ssdp_max_age, data_dir and device_uuid require restart")
+	}
+	s.mu.Lock()
+	s.config = cfg
+	s.mu.Unlock()
+
+	epgstation.Setup(cfg.EPGStationURLFor(s.hostIP))
+	contentdirectory.Configure(cfg)
+	contentdirectory.Rebuild()
+}
+
+func (s *Server) currentConfig() *config.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
 }
 
-func NewServer(deviceUUID uuid.UUID, hostIP net.IP) *Server {
+func NewServer(deviceUUID uuid.UUID, hostIP net.IP, cfg *config.Config) *Server {
 	return &Server{
 		deviceUUID: deviceUUID,
 		hostIP:     hostIP,
+		config:     cfg,
 		listener:   nil,
+		httpServer: &http.Server{},
 	}
 }
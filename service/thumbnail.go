@@ -0,0 +1,157 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png" // EPGStation may be configured to generate PNG thumbnails
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"upnp-mediaserver/epgstation"
+	"upnp-mediaserver/service/contentdirectory"
+)
+
+const thumbnailQuality = 85
+
+// thumbnailHandler serves thumbnails of EPGStation resized to DLNA image
+// profile given by profile query, JPEG_TN by default. Resized thumbnails are
+// cached in dir, as thumbnails never change once generated.
+func thumbnailHandler(dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		thumbnailId, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/thumbnails/"))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		profileID := r.URL.Query().Get("profile")
+		if profileID == "" {
+			profileID = contentdirectory.ThumbnailProfiles[0].ID
+		}
+		profile, ok := contentdirectory.LookupThumbnailProfile(profileID)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%d_%s.jpg", thumbnailId, profile.ID))
+		serve := func(modTime time.Time, content io.ReadSeeker) {
+			w.Header().Set("transferMode.dlna.org", "Interactive")
+			w.Header().Set("contentFeatures.dlna.org", profile.ContentFeatures())
+			http.ServeContent(w, r, path, modTime, content)
+		}
+
+		if f, err := os.Open(path); err == nil {
+			defer f.Close()
+			if fi, err := f.Stat(); err == nil {
+				serve(fi.ModTime(), f)
+				return
+			}
+		}
+
+		res, err := epgstation.EPGStation().GetThumbnailsThumbnailIdWithResponse(r.Context(), epgstation.PathThumbnailId(thumbnailId))
+		if err != nil {
+			log.Print(err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		if res.StatusCode() != http.StatusOK {
+			log.Printf("thumbnail %d: %s", thumbnailId, res.Status())
+			if res.StatusCode() == http.StatusNotFound {
+				http.NotFound(w, r)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		src, _, err := image.Decode(bytes.NewReader(res.Body))
+		if err != nil {
+			log.Printf("thumbnail %d: %s", thumbnailId, err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		width, height := fitSize(src.Bounds().Dx(), src.Bounds().Dy(), profile.MaxWidth, profile.MaxHeight)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resizeImage(src, width, height), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			log.Print(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if err := writeCacheFile(path, buf.Bytes()); err != nil {
+			log.Printf("could not cache thumbnail %d: %s", thumbnailId, err)
+		}
+		serve(time.Now(), bytes.NewReader(buf.Bytes()))
+	}
+}
+
+// writeCacheFile writes data to path through a temporary file, so that
+// concurrent requests never read a half-written file
+func writeCacheFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// fitSize returns size of width x height scaled down to fit in maxWidth x
+// maxHeight keeping aspect ratio. Images already fit are not scaled up.
+func fitSize(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= maxWidth && height <= maxHeight {
+		return width, height
+	}
+	if width*maxHeight > height*maxWidth {
+		return maxWidth, max(1, height*maxWidth/width)
+	}
+	return max(1, width*maxHeight/height), maxHeight
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// resizeImage scales src down to width x height averaging source pixels
+// covered by each destination pixel
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	b := src.Bounds()
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := max(y0+1, b.Min.Y+(y+1)*b.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/width)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
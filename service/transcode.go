@@ -0,0 +1,244 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"upnp-mediaserver/epgstation"
+	"upnp-mediaserver/service/contentdirectory"
+)
+
+// interval to tell EPGStation that a stream is still watched
+const streamKeepInterval = 10 * time.Second
+
+// startStream asks EPGStation to transcode video file in container and mode
+// from ss seconds, and returns the response streaming it
+func startStream(ctx context.Context, videoFileId epgstation.VideoFileId, container string, mode int, ss int) (*http.Response, error) {
+	id := epgstation.PathVideoFileId(videoFileId)
+	switch container {
+	case "mp4":
+		return epgstation.EPGStation().GetStreamsRecordedVideoFileIdMp4(ctx, id, &epgstation.GetStreamsRecordedVideoFileIdMp4Params{
+			Ss:   epgstation.StreamPlayPosition(ss),
+			Mode: epgstation.StreamMode(mode),
+		})
+	case "webm":
+		return epgstation.EPGStation().GetStreamsRecordedVideoFileIdWebm(ctx, id, &epgstation.GetStreamsRecordedVideoFileIdWebmParams{
+			Ss:   epgstation.StreamPlayPosition(ss),
+			Mode: epgstation.StreamMode(mode),
+		})
+	}
+	return nil, fmt.Errorf("unsupported container %s", container)
+}
+
+// streamIds returns ids of streams running on EPGStation which match
+func streamIds(ctx context.Context, match func(item epgstation.StreamInfoItem) bool) (map[epgstation.StreamId]bool, error) {
+	res, err := epgstation.EPGStation().GetStreamsWithResponse(ctx, &epgstation.GetStreamsParams{})
+	if err != nil {
+		return nil, err
+	}
+	if res.JSON200 == nil {
+		return nil, fmt.Errorf("streams: %s", res.Status())
+	}
+	ids := make(map[epgstation.StreamId]bool)
+	for _, item := range res.JSON200.Items {
+		if match(item) {
+			ids[item.StreamId] = true
+		}
+	}
+	return ids, nil
+}
+
+// streamStarts serializes starting streams of the same key, so that the
+// stream started is found by difference of streams matching the key
+var streamStarts = struct {
+	sync.Mutex
+	m map[string]*streamStart
+}{m: make(map[string]*streamStart)}
+
+type streamStart struct {
+	sync.Mutex
+	// number of requests holding or waiting for the lock
+	n int
+}
+
+// lockStreamStart locks starting streams of key, and returns the function
+// to unlock it
+func lockStreamStart(key string) func() {
+	streamStarts.Lock()
+	start, ok := streamStarts.m[key]
+	if !ok {
+		start = new(streamStart)
+		streamStarts.m[key] = start
+	}
+	start.n++
+	streamStarts.Unlock()
+	start.Lock()
+	return func() {
+		start.Unlock()
+		streamStarts.Lock()
+		start.n--
+		if start.n == 0 {
+			delete(streamStarts.m, key)
+		}
+		streamStarts.Unlock()
+	}
+}
+
+// startKeptStream starts a stream by start, and keeps it until ctx is done.
+// Streams of the same key, which are those matching, are started one by one.
+func startKeptStream(ctx context.Context, key string, match func(item epgstation.StreamInfoItem) bool, start func() (*http.Response, error)) (*http.Response, error) {
+	unlock := lockStreamStart(key)
+	defer unlock()
+	running, err := streamIds(ctx, match)
+	if err != nil {
+		return nil, err
+	}
+	res, err := start()
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusOK {
+		keepStarted(ctx, running, match)
+	}
+	return res, nil
+}
+
+// keepStarted keeps the stream which matches and started since running were
+// listed, until ctx is done. EPGStation does not tell id of the stream
+// started, so it is found by difference. If it is not found, as others
+// started or stopped matching streams bypassing this server, EPGStation
+// stops it when the connection is closed anyway.
+func keepStarted(ctx context.Context, running map[epgstation.StreamId]bool, match func(item epgstation.StreamInfoItem) bool) {
+	started, err := streamIds(ctx, match)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	var added []epgstation.StreamId
+	for streamId := range started {
+		if !running[streamId] {
+			added = append(added, streamId)
+		}
+	}
+	if len(added) != 1 {
+		log.Printf("stream started is not identified among %d new streams, not kept", len(added))
+		return
+	}
+	go keepStream(ctx, added[0])
+}
+
+// keepStream tells EPGStation that stream streamId is watched until ctx is
+// done, then stops it
+func keepStream(ctx context.Context, streamId epgstation.StreamId) {
+	ticker := time.NewTicker(streamKeepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := epgstation.EPGStation().PutStreamsStreamIdKeepWithResponse(ctx, epgstation.PathStreamId(streamId)); err != nil && ctx.Err() == nil {
+				log.Printf("stream %d: %s", streamId, err)
+			}
+		case <-ctx.Done():
+			// request context is done already
+			stopCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := epgstation.EPGStation().DeleteStreamsStreamIdWithResponse(stopCtx, epgstation.PathStreamId(streamId)); err != nil {
+				log.Printf("stream %d: %s", streamId, err)
+			}
+			return
+		}
+	}
+}
+
+// transcodedVideoStreamHandler streams a recorded TS file transcoded by
+// EPGStation in one of stream modes. Time seek starts transcoding from the
+// position, as bytes of transcoded stream are unknown beforehand.
+func transcodedVideoStreamHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	videoFileId, err := strconv.Atoi(query.Get("videoFileId"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	container := query.Get("container")
+	mode, err := strconv.Atoi(query.Get("mode"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if _, ok := contentdirectory.LookupStreamMode(container, mode); !ok {
+		http.NotFound(w, r)
+		return
+	}
+	resource, err := contentdirectory.LookupResource(r.Context(), epgstation.VideoFileId(videoFileId))
+	if errors.Is(err, contentdirectory.ErrNoSuchResource) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	if resource.Recording || resource.VideoFile.Type != epgstation.VideoFileTypeTs {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("videoFileId: %d, %s mode %d", videoFileId, container, mode)
+
+	var ss int
+	if timeSeekReqHeader := r.Header.Get("Timeseekrange.dlna.org"); timeSeekReqHeader != "" {
+		log.Printf("Timeseekrange.dlna.org: %s", timeSeekReqHeader)
+		startDuration, startStr := parseTimeSeekHeader(timeSeekReqHeader)
+		if startDuration >= resource.Duration {
+			http.Error(w, http.StatusText(http.StatusRequestedRangeNotSatisfiable), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		ss = int(startDuration / time.Second)
+		duration := contentdirectory.FormatDuration(resource.Duration)
+		w.Header().Set("Timeseekrange.dlna.org", fmt.Sprintf("npt=%s-%s/%s", startStr, duration, duration))
+	}
+	w.Header().Set("transferMode.dlna.org", "Streaming")
+	w.Header().Set("contentFeatures.dlna.org", contentdirectory.StreamContentFeatures(container))
+	if r.Method == http.MethodHead {
+		// clients often ask headers before playing, not worth transcoding
+		w.Header().Set("Content-Type", "video/"+container)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	match := func(item epgstation.StreamInfoItem) bool {
+		return item.VideoFileId != nil && *item.VideoFileId == resource.VideoFile.Id && int(item.Mode) == mode
+	}
+	key := fmt.Sprintf("recorded/%d/%d", resource.VideoFile.Id, mode)
+	res, err := startKeptStream(ctx, key, match, func() (*http.Response, error) {
+		return startStream(ctx, resource.VideoFile.Id, container, mode, ss)
+	})
+	if err != nil {
+		log.Print(err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		log.Printf("stream of video %d: %s", resource.VideoFile.Id, res.Status)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "video/" + container
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, res.Body)
+}
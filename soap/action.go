@@ -1,38 +1,104 @@
 package soap
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"upnp-mediaserver/service/contentdirectory"
 	"log"
+	"strings"
 )
 
 type Action struct {
+	ctx context.Context
 }
 
-func (a Action) Browse(ObjectID string, BrowseFlag string, Filter string, StartingIndex int, RequestedCount int, SortCriteria string) (string, int, int, int) {
+// upnpError converts error from contentdirectory package to UPnPError
+func upnpError(err error) error {
+	switch {
+	case errors.Is(err, contentdirectory.ErrNoSuchObject):
+		return fmt.Errorf("%w (%s)", ErrNoSuchObject, err)
+	case errors.Is(err, contentdirectory.ErrInvalidSearchCriteria):
+		return fmt.Errorf("%w (%s)", ErrInvalidSearchCriteria, err)
+	case errors.Is(err, contentdirectory.ErrInvalidSortCriteria):
+		return fmt.Errorf("%w (%s)", ErrInvalidSortCriteria, err)
+	default:
+		return fmt.Errorf("%w (%s)", ErrCannotProcessRequest, err)
+	}
+}
+
+func (a Action) Browse(ObjectID string, BrowseFlag string, Filter string, StartingIndex int, RequestedCount int, SortCriteria string) (string, int, int, int, error) {
+	if StartingIndex < 0 || RequestedCount < 0 {
+		return "", 0, 0, 0, ErrInvalidArgs
+	}
+	// Result, NumberReturned, TotalMatches, UpdateID
 	switch BrowseFlag {
 	case "BrowseMetadata":
-		return contentdirectory.MarshalMetadata(ObjectID), 1, 1, a.GetSystemUpdateID()
+		result, err := contentdirectory.MarshalMetadata(a.ctx, ObjectID, Filter)
+		if err != nil {
+			return "", 0, 0, 0, upnpError(err)
+		}
+		return result, 1, 1, a.GetSystemUpdateID(), nil
 	case "BrowseDirectChildren":
-		container := contentdirectory.GetObject(ObjectID).(*contentdirectory.Container)
-		return contentdirectory.MarshalDirectChildren(ObjectID, StartingIndex, RequestedCount), container.ChildCount - StartingIndex, container.ChildCount, a.GetSystemUpdateID()
+		result, numberReturned, totalMatches, err := contentdirectory.MarshalDirectChildren(a.ctx, ObjectID, Filter, SortCriteria, StartingIndex, RequestedCount)
+		if err != nil {
+			return "", 0, 0, 0, upnpError(err)
+		}
+		return result, numberReturned, totalMatches, a.GetSystemUpdateID(), nil
 	default:
 		log.Printf("invalid BrowseFlag: %s", BrowseFlag)
-		// Result, NumberReturned, TotalMatches, UpdateID
-		return "", 0, 0, a.GetSystemUpdateID()
+		return "", 0, 0, 0, ErrInvalidArgs
+	}
+}
+
+func (a Action) Search(ContainerID string, SearchCriteria string, Filter string, StartingIndex int, RequestedCount int, SortCriteria string) (string, int, int, int, error) {
+	if StartingIndex < 0 || RequestedCount < 0 {
+		return "", 0, 0, 0, ErrInvalidArgs
+	}
+	result, numberReturned, totalMatches, err := contentdirectory.Search(a.ctx, ContainerID, SearchCriteria, Filter, SortCriteria, StartingIndex, RequestedCount)
+	if err != nil {
+		if errors.Is(err, contentdirectory.ErrNoSuchObject) {
+			return "", 0, 0, 0, fmt.Errorf("%w (%s)", ErrNoSuchContainer, err)
+		}
+		return "", 0, 0, 0, upnpError(err)
 	}
+	// Result, NumberReturned, TotalMatches, UpdateID
+	return result, numberReturned, totalMatches, a.GetSystemUpdateID(), nil
 }
 
 func (a Action) GetSystemUpdateID() int {
 	// SystemUpdateID
-	return contentdirectory.GetRecordedTotal()
+	return contentdirectory.SystemUpdateID()
 }
 
 func (a Action) GetSearchCapabilities() string {
 	// SearchCapabilities
-	return ""
+	return strings.Join(contentdirectory.SearchCapabilities, ",")
 }
 
 func (a Action) GetSortCapabilities() string {
 	// SortCapabilities
-	return ""
+	return strings.Join(contentdirectory.SortCapabilities, ",")
+}
+
+type ConnectionManagerAction struct {
+}
+
+func (a ConnectionManagerAction) GetProtocolInfo() (string, string) {
+	// Source, Sink
+	return strings.Join(contentdirectory.SourceProtocolInfos(), ","), ""
+}
+
+func (a ConnectionManagerAction) GetCurrentConnectionIDs() string {
+	// ConnectionIDs
+	// PrepareForConnection is not implemented, so only the default connection 0 exists
+	return "0"
+}
+
+func (a ConnectionManagerAction) GetCurrentConnectionInfo(ConnectionID int) (int, int, string, string, int, string, string, error) {
+	if ConnectionID != 0 {
+		return 0, 0, "", "", 0, "", "", ErrInvalidConnectionReference
+	}
+	// RcsID, AVTransportID, ProtocolInfo, PeerConnectionManager, PeerConnectionID, Direction, Status
+	return -1, -1, "", "", -1, "Output", "OK", nil
 }
@@ -0,0 +1,65 @@
+package soap
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+// UPnPError is an error reported to control point as SOAP fault
+type UPnPError struct {
+	Code        int
+	Description string
+}
+
+func (e *UPnPError) Error() string {
+	return fmt.Sprintf("UPnPError %d: %s", e.Code, e.Description)
+}
+
+// errors defined in UPnP Device Architecture 1.0
+var (
+	ErrInvalidAction = &UPnPError{401, "Invalid Action"}
+	ErrInvalidArgs   = &UPnPError{402, "Invalid Args"}
+	ErrActionFailed  = &UPnPError{501, "Action Failed"}
+)
+
+// errors defined in ContentDirectory:1 and ConnectionManager:1
+var (
+	ErrInvalidConnectionReference = &UPnPError{706, "Invalid connection reference"}
+	ErrNoSuchObject               = &UPnPError{701, "No such object"}
+	ErrInvalidSearchCriteria      = &UPnPError{708, "Unsupported or invalid search criteria"}
+	ErrInvalidSortCriteria        = &UPnPError{709, "Unsupported or invalid sort criteria"}
+	ErrNoSuchContainer            = &UPnPError{710, "No such container"}
+	ErrCannotProcessRequest       = &UPnPError{720, "Cannot process the request"}
+)
+
+type Fault struct {
+	XMLName       xml.Name `xml:"s:Envelope"`
+	XMLNS         string   `xml:"xmlns:s,attr"`
+	EncodingStyle string   `xml:"s:encodingStyle,attr"`
+	Body          struct {
+		Fault struct {
+			FaultCode   string `xml:"faultcode"`
+			FaultString string `xml:"faultstring"`
+			Detail      struct {
+				UPnPError struct {
+					XMLNS            string `xml:"xmlns,attr"`
+					ErrorCode        int    `xml:"errorCode"`
+					ErrorDescription string `xml:"errorDescription"`
+				} `xml:"UPnPError"`
+			} `xml:"detail"`
+		} `xml:"s:Fault"`
+	} `xml:"s:Body"`
+}
+
+func marshalFault(upnpErr *UPnPError) []byte {
+	var fault Fault
+	fault.XMLNS = "http://schemas.xmlsoap.org/soap/envelope/"
+	fault.EncodingStyle = "http://schemas.xmlsoap.org/soap/encoding/"
+	fault.Body.Fault.FaultCode = "s:Client"
+	fault.Body.Fault.FaultString = "UPnPError"
+	fault.Body.Fault.Detail.UPnPError.XMLNS = "urn:schemas-upnp-org:control-1-0"
+	fault.Body.Fault.Detail.UPnPError.ErrorCode = upnpErr.Code
+	fault.Body.Fault.Detail.UPnPError.ErrorDescription = upnpErr.Description
+	res, _ := xml.Marshal(fault)
+	return res
+}
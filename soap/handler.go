@@ -1,37 +1,102 @@
 package soap
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"reflect"
 	"regexp"
-	"log"
+	"runtime/debug"
 )
 
-const actionNameRegexp = `"urn:schemas-upnp-org:service:ContentDirectory:1#(.+)"`
+var actionNameRegexp = regexp.MustCompile(`"?urn:schemas-upnp-org:service:(\w+):1#(\w+)"?`)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// receiver of actions for each service type, made for each request
+var services = map[string]func(ctx context.Context) interface{}{
+	"ContentDirectory":  func(ctx context.Context) interface{} { return &Action{ctx: ctx} },
+	"ConnectionManager": func(ctx context.Context) interface{} { return &ConnectionManagerAction{} },
+}
 
-func HandleAction(r *http.Request) []byte {
-	actionName := regexp.MustCompile(actionNameRegexp).FindStringSubmatch(r.Header.Get("SoapAction"))[1]
-	log.Printf("Handling action: %s", actionName);
-	data, _ := ioutil.ReadAll(r.Body)
+// HandleAction invokes action requested by r, then returns SOAP response
+// body and HTTP status code. Failure of the action is returned as SOAP fault.
+func HandleAction(r *http.Request) ([]byte, int) {
+	res, err := handleAction(r)
+	if err != nil {
+		var upnpErr *UPnPError
+		if !errors.As(err, &upnpErr) {
+			upnpErr = ErrActionFailed
+		}
+		log.Printf("Action failed: %s", err)
+		return marshalFault(upnpErr), http.StatusInternalServerError
+	}
+	return res, http.StatusOK
+}
+
+func handleAction(r *http.Request) (res []byte, err error) {
+	match := actionNameRegexp.FindStringSubmatch(r.Header.Get("SoapAction"))
+	if match == nil {
+		log.Printf("invalid SOAPAction header: %s", r.Header.Get("SoapAction"))
+		return nil, ErrInvalidAction
+	}
+	serviceName, actionName := match[1], match[2]
+	log.Printf("Handling action: %s#%s", serviceName, actionName)
+	newService, ok := services[serviceName]
+	if !ok {
+		return nil, ErrInvalidAction
+	}
+	// actions give up asking EPGStation when the control point gives up
+	method := reflect.ValueOf(newService(r.Context())).MethodByName(actionName)
+	reqStructFieldPtr := reflect.ValueOf(Request{}.Body).FieldByName(actionName)
+	resStructField, hasResponse := reflect.TypeOf(Response{}.Body).FieldByName(actionName + "Response")
+	if !method.IsValid() || !reqStructFieldPtr.IsValid() || !hasResponse {
+		return nil, ErrInvalidAction
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
 	var soapReq Request
-	xml.Unmarshal(data, &soapReq)
-	reqStruct := reflect.ValueOf(soapReq.Body).FieldByName(actionName).Elem()
+	if err := xml.Unmarshal(data, &soapReq); err != nil {
+		log.Printf("could not parse request: %s", err)
+		return nil, ErrInvalidArgs
+	}
+	reqStructPtr := reflect.ValueOf(soapReq.Body).FieldByName(actionName)
+	if reqStructPtr.IsNil() {
+		return nil, ErrInvalidArgs
+	}
+	reqStruct := reqStructPtr.Elem()
 	argv := make([]reflect.Value, reqStruct.NumField()-1)
 	for i := range argv {
 		argv[i] = reqStruct.Field(i + 1) // skip XMLName field
 	}
-	result := reflect.ValueOf(&Action{}).MethodByName(actionName).Call(argv)
+
+	defer func() {
+		// a bug in an action must not take the whole server down
+		if rec := recover(); rec != nil {
+			log.Printf("panic in action %s: %v\n%s", actionName, rec, debug.Stack())
+			res, err = nil, ErrActionFailed
+		}
+	}()
+	result := method.Call(argv)
+	if n := len(result); n > 0 && result[n-1].Type() == errorType {
+		if err, _ := result[n-1].Interface().(error); err != nil {
+			return nil, err
+		}
+		result = result[:n-1]
+	}
 
 	var soapRes Response
 	soapRes.EncodingStyle = "http://schemas.xmlsoap.org/soap/encoding/"
-	resStructFieldPtr := reflect.ValueOf(soapRes.Body).FieldByName(actionName + "Response")
-	resStructPtr := reflect.New(resStructFieldPtr.Type().Elem())
+	resStructPtr := reflect.New(resStructField.Type.Elem())
 	for i, v := range result {
 		resStructPtr.Elem().Field(i + 1).Set(v) // skip XMLName field
 	}
 	reflect.ValueOf(&soapRes.Body).Elem().FieldByName(actionName + "Response").Set(resStructPtr)
-	res, _ := xml.Marshal(soapRes)
-	return res
+	return xml.Marshal(soapRes)
 }
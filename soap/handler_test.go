@@ -0,0 +1,135 @@
+package soap
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"upnp-mediaserver/config"
+	"upnp-mediaserver/epgstation"
+	"upnp-mediaserver/service/contentdirectory"
+)
+
+// panickingAction has Browse of ContentDirectory which always panics
+type panickingAction struct{}
+
+func (panickingAction) Browse(ObjectID string, BrowseFlag string, Filter string, StartingIndex int, RequestedCount int, SortCriteria string) (string, int, int, int, error) {
+	panic("bug in action")
+}
+
+// postAction invokes action of service with arguments in envelope through
+// HandleAction, and returns the response body and status code
+func postAction(service, action, arguments string) ([]byte, int) {
+	body := fmt.Sprintf(`<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%s xmlns:u="urn:schemas-upnp-org:service:%s:1">%s</u:%s></s:Body>
+</s:Envelope>`, action, service, arguments, action)
+	r := httptest.NewRequest(http.MethodPost, "/"+service+"/control.xml", strings.NewReader(body))
+	r.Header.Set("SOAPAction", fmt.Sprintf(`"urn:schemas-upnp-org:service:%s:1#%s"`, service, action))
+	return HandleAction(r)
+}
+
+func browseArguments(objectID, browseFlag, startingIndex, sortCriteria string) string {
+	return fmt.Sprintf("<ObjectID>%s</ObjectID><BrowseFlag>%s</BrowseFlag><Filter>*</Filter><StartingIndex>%s</StartingIndex><RequestedCount>0</RequestedCount><SortCriteria>%s</SortCriteria>",
+		objectID, browseFlag, startingIndex, sortCriteria)
+}
+
+func TestHandleActionFault(t *testing.T) {
+	// nothing listens on the port, so that resolving containers fails
+	epgstation.Setup("http://127.0.0.1:1")
+	contentdirectory.Configure(&config.Config{RefreshInterval: time.Hour, CacheTTL: time.Hour})
+	contentdirectory.Setup("http://127.0.0.1/")
+
+	tests := []struct {
+		name      string
+		service   string
+		action    string
+		arguments string
+		wantCode  int
+	}{
+		{"unknown action", "ContentDirectory", "DestroyObject", "<ObjectID>0</ObjectID>", 401},
+		{"unknown service", "AVTransport", "Play", "", 401},
+		{"malformed argument", "ContentDirectory", "Browse", browseArguments("0", "BrowseDirectChildren", "first", ""), 402},
+		{"unknown BrowseFlag", "ContentDirectory", "Browse", browseArguments("0", "BrowseAll", "0", ""), 402},
+		{"negative StartingIndex", "ContentDirectory", "Browse", browseArguments("0", "BrowseDirectChildren", "-1", ""), 402},
+		{"unknown ObjectID", "ContentDirectory", "Browse", browseArguments("nonexistent", "BrowseMetadata", "0", ""), 701},
+		{"invalid SearchCriteria", "ContentDirectory", "Search", `<ContainerID>0</ContainerID><SearchCriteria>dc:title = </SearchCriteria><Filter>*</Filter><StartingIndex>0</StartingIndex><RequestedCount>0</RequestedCount><SortCriteria></SortCriteria>`, 708},
+		{"invalid SortCriteria", "ContentDirectory", "Browse", browseArguments("0", "BrowseDirectChildren", "0", "+upnp:rating"), 709},
+		{"unknown container to search", "ContentDirectory", "Search", `<ContainerID>nonexistent</ContainerID><SearchCriteria>*</SearchCriteria><Filter>*</Filter><StartingIndex>0</StartingIndex><RequestedCount>0</RequestedCount><SortCriteria></SortCriteria>`, 710},
+		{"EPGStation unreachable", "ContentDirectory", "Browse", browseArguments("recorded", "BrowseDirectChildren", "0", ""), 720},
+		{"unknown ConnectionID", "ConnectionManager", "GetCurrentConnectionInfo", "<ConnectionID>1</ConnectionID>", 706},
+	}
+	for _, tt := range tests {
+		res, statusCode := postAction(tt.service, tt.action, tt.arguments)
+		if statusCode != http.StatusInternalServerError {
+			t.Errorf("%s: status %d, want %d", tt.name, statusCode, http.StatusInternalServerError)
+		}
+		if code := faultCode(t, res); code != tt.wantCode {
+			t.Errorf("%s: errorCode %d, want %d", tt.name, code, tt.wantCode)
+		}
+	}
+}
+
+func TestHandleActionPanic(t *testing.T) {
+	newService := services["ContentDirectory"]
+	services["ContentDirectory"] = func(ctx context.Context) interface{} { return panickingAction{} }
+	defer func() { services["ContentDirectory"] = newService }()
+
+	res, statusCode := postAction("ContentDirectory", "Browse", browseArguments("0", "BrowseMetadata", "0", ""))
+	if statusCode != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", statusCode, http.StatusInternalServerError)
+	}
+	if code := faultCode(t, res); code != ErrActionFailed.Code {
+		t.Errorf("errorCode %d, want %d", code, ErrActionFailed.Code)
+	}
+}
+
+func TestConnectionManager(t *testing.T) {
+	res, statusCode := postAction("ConnectionManager", "GetProtocolInfo", "")
+	if statusCode != http.StatusOK {
+		t.Fatalf("GetProtocolInfo: status %d: %s", statusCode, res)
+	}
+	var protocolInfo struct {
+		Source string `xml:"Body>GetProtocolInfoResponse>Source"`
+		Sink   string `xml:"Body>GetProtocolInfoResponse>Sink"`
+	}
+	if err := xml.Unmarshal(res, &protocolInfo); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(protocolInfo.Source, "http-get:*:video/mpeg:") || !strings.Contains(protocolInfo.Source, "http-get:*:image/jpeg:DLNA.ORG_PN=JPEG_TN") || protocolInfo.Sink != "" {
+		t.Errorf("GetProtocolInfo: Source %q, Sink %q", protocolInfo.Source, protocolInfo.Sink)
+	}
+
+	res, statusCode = postAction("ConnectionManager", "GetCurrentConnectionInfo", "<ConnectionID>0</ConnectionID>")
+	if statusCode != http.StatusOK {
+		t.Fatalf("GetCurrentConnectionInfo: status %d: %s", statusCode, res)
+	}
+	var connectionInfo struct {
+		RcsID     int    `xml:"Body>GetCurrentConnectionInfoResponse>RcsID"`
+		Direction string `xml:"Body>GetCurrentConnectionInfoResponse>Direction"`
+		Status    string `xml:"Body>GetCurrentConnectionInfoResponse>Status"`
+	}
+	if err := xml.Unmarshal(res, &connectionInfo); err != nil {
+		t.Fatal(err)
+	}
+	if connectionInfo.RcsID != -1 || connectionInfo.Direction != "Output" || connectionInfo.Status != "OK" {
+		t.Errorf("GetCurrentConnectionInfo: %+v", connectionInfo)
+	}
+}
+
+// faultCode returns errorCode of SOAP fault res
+func faultCode(t *testing.T, res []byte) int {
+	t.Helper()
+	var fault struct {
+		ErrorCode int `xml:"Body>Fault>detail>UPnPError>errorCode"`
+	}
+	if err := xml.Unmarshal(res, &fault); err != nil {
+		t.Fatalf("invalid fault %s: %s", res, err)
+	}
+	return fault.ErrorCode
+}
@@ -11,9 +11,14 @@ type Request struct {
 	Body          struct {
 		XMLName               xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
 		Browse                *Browse
+		Search                *Search
 		GetSystemUpdateID     *GetSystemUpdateID
 		GetSearchCapabilities *GetSearchCapabilities
 		GetSortCapabilities   *GetSortCapabilities
+
+		GetProtocolInfo          *GetProtocolInfo
+		GetCurrentConnectionIDs  *GetCurrentConnectionIDs
+		GetCurrentConnectionInfo *GetCurrentConnectionInfo
 	}
 }
 
@@ -23,9 +28,14 @@ type Response struct {
 	Body          struct {
 		XMLName                       xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
 		BrowseResponse                *BrowseResponse
+		SearchResponse                *SearchResponse
 		GetSystemUpdateIDResponse     *GetSystemUpdateIDResponse
 		GetSearchCapabilitiesResponse *GetSearchCapabilitiesResponse
 		GetSortCapabilitiesResponse   *GetSortCapabilitiesResponse
+
+		GetProtocolInfoResponse          *GetProtocolInfoResponse
+		GetCurrentConnectionIDsResponse  *GetCurrentConnectionIDsResponse
+		GetCurrentConnectionInfoResponse *GetCurrentConnectionInfoResponse
 	}
 }
 
@@ -47,6 +57,24 @@ type BrowseResponse struct {
 	UpdateID       int
 }
 
+type Search struct {
+	XMLName        xml.Name `xml:"urn:schemas-upnp-org:service:ContentDirectory:1 Search"`
+	ContainerID    string
+	SearchCriteria string
+	Filter         string
+	StartingIndex  int
+	RequestedCount int
+	SortCriteria   string
+}
+
+type SearchResponse struct {
+	XMLName        xml.Name `xml:"urn:schemas-upnp-org:service:ContentDirectory:1 SearchResponse"`
+	Result         string
+	NumberReturned int
+	TotalMatches   int
+	UpdateID       int
+}
+
 type GetSystemUpdateID struct {
 	XMLName xml.Name `xml:"urn:schemas-upnp-org:service:ContentDirectory:1 GetSystemUpdateID"`
 }
@@ -74,6 +102,41 @@ type GetSortCapabilitiesResponse struct {
 	SortCaps string
 }
 
+type GetProtocolInfo struct {
+	XMLName xml.Name `xml:"urn:schemas-upnp-org:service:ConnectionManager:1 GetProtocolInfo"`
+}
+
+type GetProtocolInfoResponse struct {
+	XMLName xml.Name `xml:"urn:schemas-upnp-org:service:ConnectionManager:1 GetProtocolInfoResponse"`
+	Source  string
+	Sink    string
+}
+
+type GetCurrentConnectionIDs struct {
+	XMLName xml.Name `xml:"urn:schemas-upnp-org:service:ConnectionManager:1 GetCurrentConnectionIDs"`
+}
+
+type GetCurrentConnectionIDsResponse struct {
+	XMLName       xml.Name `xml:"urn:schemas-upnp-org:service:ConnectionManager:1 GetCurrentConnectionIDsResponse"`
+	ConnectionIDs string
+}
+
+type GetCurrentConnectionInfo struct {
+	XMLName      xml.Name `xml:"urn:schemas-upnp-org:service:ConnectionManager:1 GetCurrentConnectionInfo"`
+	ConnectionID int
+}
+
+type GetCurrentConnectionInfoResponse struct {
+	XMLName               xml.Name `xml:"urn:schemas-upnp-org:service:ConnectionManager:1 GetCurrentConnectionInfoResponse"`
+	RcsID                 int
+	AVTransportID         int
+	ProtocolInfo          string
+	PeerConnectionManager string
+	PeerConnectionID      int
+	Direction             string
+	Status                string
+}
+
 // <DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">
 
 type DIDLLite struct {
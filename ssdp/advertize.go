@@ -2,6 +2,7 @@ package ssdp
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -17,12 +18,12 @@ const (
 	ntsByebye    = `ssdp:byebye`
 	ntsUpdate    = `ssdp:update`
 	serverName   = "Linux/i686 UPnP/1.0 go-upnp-playground/0.0.1"
-	maxAge       = 1800
 )
 
 type SSDPAdvertiser struct {
 	deviceUUID uuid.UUID
 	urlBase    string
+	maxAge     int
 }
 
 func (s *SSDPAdvertiser) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -40,10 +41,11 @@ func (s *SSDPAdvertiser) RoundTrip(req *http.Request) (*http.Response, error) {
 	return &http.Response{}, nil
 }
 
-func NewSSDPAdvertiser(deviceUUID uuid.UUID, urlBase string) SSDPAdvertiser {
+func NewSSDPAdvertiser(deviceUUID uuid.UUID, urlBase string, maxAge int) SSDPAdvertiser {
 	return SSDPAdvertiser{
 		deviceUUID: deviceUUID,
 		urlBase:    urlBase,
+		maxAge:     maxAge,
 	}
 }
 
@@ -71,7 +73,7 @@ func (s *SSDPAdvertiser) notifyTarget(target string) {
 		Header: http.Header{
 			// Putting headers in here avoids them being title-cased.
 			// (The UPnP discovery protocol uses case-sensitive headers)
-			"Cache-Control": {fmt.Sprintf("max-age=%d", maxAge)},
+			"Cache-Control": {fmt.Sprintf("max-age=%d", s.maxAge)},
 			"Location":      {s.urlBase},
 			"Server":        {serverName},
 			"NT":            {NT},
@@ -122,12 +124,17 @@ func (s *SSDPAdvertiser) NotifyByebye() {
 	}
 }
 
-func (s *SSDPAdvertiser) Serve() error {
+// Serve advertises the device periodically until ctx is done.
+func (s *SSDPAdvertiser) Serve(ctx context.Context) error {
 	// Devices should wait a random interval less than 100 milliseconds before sending an initial set of advertisements in order to
 	// reduce the likelihood of network storms
-	waitRandomMillis(100)
+	if err := sleepRandomMillis(ctx, 100); err != nil {
+		return err
+	}
 	for {
 		s.NotifyAlive()
-		waitRandomMillis((maxAge / 2) * 1000)
+		if err := sleepRandomMillis(ctx, int64(s.maxAge/2)*1000); err != nil {
+			return err
+		}
 	}
 }
@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -34,6 +35,11 @@ type SSDPDiscoveryResponder struct {
 	Interface  *net.Interface // Network interface to listen on for multicast, nil for default multicast interface
 	Handler    Handler        // handler to invoke
 	deviceUUID uuid.UUID
+	maxAge     int
+
+	mu     sync.Mutex
+	conn   net.PacketConn
+	closed bool
 }
 
 // ListenAndServe listens on the UDP network address srv.Addr. If srv.Multicast
@@ -58,9 +64,29 @@ func (s *SSDPDiscoveryResponder) ListenAndServe() error {
 		}
 	}
 
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
 	return s.Serve(conn)
 }
 
+// Close stops ListenAndServe. ListenAndServe returns net.ErrClosed after Close.
+func (s *SSDPDiscoveryResponder) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
 type UDPResponseWriter struct {
 	conn         net.PacketConn
 	addr         net.Addr
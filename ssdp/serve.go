@@ -1,6 +1,7 @@
 package ssdp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -20,11 +21,12 @@ const (
 	vendor                = "Linux/i686 UPnP/1.0 go-upnp-playground/0.0.1"
 )
 
-func NewSSDPDiscoveryResponder(deviceUUID uuid.UUID, urlBase string) SSDPDiscoveryResponder {
-	return SSDPDiscoveryResponder{
+func NewSSDPDiscoveryResponder(deviceUUID uuid.UUID, urlBase string, maxAge int) *SSDPDiscoveryResponder {
+	return &SSDPDiscoveryResponder{
 		Multicast:  true,
 		deviceUUID: deviceUUID,
 		urlBase:    urlBase,
+		maxAge:     maxAge,
 	}
 }
 
@@ -53,6 +55,19 @@ func waitRandomMillis(mx int64) {
 	time.Sleep(time.Duration(randSleepMilliSeconds) * time.Millisecond)
 }
 
+// sleepRandomMillis is waitRandomMillis which returns ctx.Err() as soon as ctx is done.
+func sleepRandomMillis(ctx context.Context, mx int64) error {
+	randSleepMilliSeconds := rand.Int63n(mx)
+	timer := time.NewTimer(time.Duration(randSleepMilliSeconds) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 func (srv *SSDPDiscoveryResponder) ServeMessage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "M-SEARCH" {
 		return
@@ -71,7 +86,7 @@ func (srv *SSDPDiscoveryResponder) ServeMessage(w http.ResponseWriter, r *http.R
 	}
 	waitRandomMillis(mx * 1000)
 	h := w.Header()
-	h.Set("Cache-Control", "max-age=1800")
+	h.Set("Cache-Control", fmt.Sprintf("max-age=%d", srv.maxAge))
 	h.Set("Location", srv.urlBase)
 	h.Set("Server", vendor)
 	h.Set("EXT", "")